@@ -0,0 +1,260 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/html"
+	"strings"
+	"sync"
+)
+
+/*
+A Command is called when CompileTemplate finds a registered attribute command
+in a start tag.
+
+The value is the value of the attribute.  The CommandCompiler is used to add
+behaviour to the element.  Any error returned stops compilation of the
+template.
+*/
+type Command func(c *CommandCompiler, value string) error
+
+/*
+A RenderFunc is executed when a template is rendered.
+
+RenderFuncs are added to a template by a Command using CommandCompiler.Render
+and CommandCompiler.ContentFunc.
+*/
+type RenderFunc func(r *RenderState) (interface{}, error)
+
+// commandRegistry holds all commands registered using RegisterCommand.
+var commandRegistry = struct {
+	sync.RWMutex
+	commands map[string]commandProperties
+}{commands: make(map[string]commandProperties)}
+
+/*
+RegisterCommand makes a new attribute command available to all templates
+compiled afterwards.
+
+The name is the full attribute name including a namespace prefix, for example
+"x:track".  Attribute names are matched without regard to case.
+
+The priority determines the order in which commands on the same element are
+handled, lowest first.  The built in commands use priorities 0 to 10 in the
+following order: metal:define-macro, metal:use-macro, metal:define-slot,
+metal:fill-slot, tal:define, tal:condition, tal:repeat, tal:content,
+tal:replace, tal:attributes and tal:omit-tag.  For example, a command with a
+priority of 5 is handled after tal:define and before tal:repeat.
+
+An error is returned if the name has no prefix or is already in use.
+*/
+func RegisterCommand(name string, priority int, command Command) error {
+	name = strings.ToLower(name)
+	prefixEnd := strings.Index(name, ":")
+	if prefixEnd < 1 || prefixEnd == len(name)-1 {
+		return fmt.Errorf("tal: command name %q must have a namespace prefix", name)
+	}
+	if command == nil {
+		return errors.New("tal: RegisterCommand called with a nil Command")
+	}
+	if _, ok := talCommandProperties[name]; ok {
+		return fmt.Errorf("tal: command %q is a built in command", name)
+	}
+	commandRegistry.Lock()
+	defer commandRegistry.Unlock()
+	if _, ok := commandRegistry.commands[name]; ok {
+		return fmt.Errorf("tal: command %q is already registered", name)
+	}
+	commandRegistry.commands[name] = commandProperties{Priority: priority, StartAction: customCommandStart(command)}
+	return nil
+}
+
+/*
+registeredCommand returns the properties of a command registered using
+RegisterCommand.
+*/
+func registeredCommand(name string) (commandProperties, bool) {
+	commandRegistry.RLock()
+	defer commandRegistry.RUnlock()
+	properties, ok := commandRegistry.commands[name]
+	return properties, ok
+}
+
+/*
+customCommandStart returns a startActionFunc that runs the given Command.
+
+Errors that are not already a CompileError are wrapped in one of type
+ErrCommandFailed.
+*/
+func customCommandStart(command Command) startActionFunc {
+	return func(originalAttributes []html.Attribute, talValue string, state *compileState) *CompileError {
+		err := command(&CommandCompiler{state: state, originalAttributes: originalAttributes}, talValue)
+		if err == nil {
+			return nil
+		}
+		compileErr, ok := err.(*CompileError)
+		if !ok {
+			compileErr = state.error(ErrCommandFailed)
+			compileErr.Err = err
+		}
+		return compileErr
+	}
+}
+
+/*
+CommandCompiler is used by a Command to change how the element it is on is
+compiled.
+
+The methods correspond to the built in tal commands and take TALES
+expressions as arguments.  Each behaves as if the corresponding tal command
+was present on the element, subject to the priority of the Command.
+*/
+type CommandCompiler struct {
+	state              *compileState
+	originalAttributes []html.Attribute
+}
+
+// TagName returns the name of the element the command is on.
+func (c *CommandCompiler) TagName() string {
+	return string(c.state.talStartTag.tagName)
+}
+
+// Attributes returns a copy of the element's attributes, excluding any commands.
+func (c *CommandCompiler) Attributes() []html.Attribute {
+	return append([]html.Attribute(nil), c.originalAttributes...)
+}
+
+/*
+Error returns a CompileError of the given kind, with the context of where the
+command is in the template.
+*/
+func (c *CommandCompiler) Error(errorType CompileErrorKind) *CompileError {
+	return c.state.error(errorType)
+}
+
+// Define sets a local or global variable, in the same way as tal:define.
+func (c *CommandCompiler) Define(name string, expression string, global bool) {
+	c.state.template.addInstruction(&defineVariable{name: name, global: global, expression: expression, originalAttributes: c.originalAttributes})
+	if !global {
+		c.state.appendAction(getTalDefineEndAction(c.state.template))
+	}
+}
+
+// Condition only outputs the element if the expression is true, in the same way as tal:condition.
+func (c *CommandCompiler) Condition(expression string) error {
+	if err := talConditionStart(c.originalAttributes, expression, c.state); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Content replaces the content of the element, in the same way as tal:content.
+func (c *CommandCompiler) Content(expression string, structure bool) {
+	c.state.talStartTag.replaceCommand = false
+	c.state.talStartTag.contentExpression = expression
+	c.state.talStartTag.contentFunc = nil
+	c.state.talStartTag.contentStructure = structure
+	c.state.guardMacroUses()
+}
+
+// Replace replaces the element, in the same way as tal:replace.
+func (c *CommandCompiler) Replace(expression string, structure bool) {
+	c.Content(expression, structure)
+	c.state.talStartTag.replaceCommand = true
+}
+
+/*
+ContentFunc replaces the content of the element with the value returned by
+the RenderFunc.  The value is treated in the same way as the value of a
+tal:content expression.
+*/
+func (c *CommandCompiler) ContentFunc(fn RenderFunc, structure bool) {
+	c.state.talStartTag.replaceCommand = false
+	c.state.talStartTag.contentExpression = ""
+	c.state.talStartTag.contentFunc = fn
+	c.state.talStartTag.contentStructure = structure
+	c.state.guardMacroUses()
+}
+
+// Attribute sets the value of an attribute, in the same way as tal:attributes.
+func (c *CommandCompiler) Attribute(name string, expression string) {
+	c.state.talStartTag.attributeExpression = append(c.state.talStartTag.attributeExpression, html.Attribute{Key: name, Val: expression})
+}
+
+// OmitTag removes the start and end tags if the expression is true, in the same way as tal:omit-tag.
+func (c *CommandCompiler) OmitTag(expression string) {
+	talOmitTagStart(c.originalAttributes, expression, c.state)
+}
+
+/*
+Render adds a RenderFunc that is executed each time the template reaches this
+point, before the start tag is output.  The value returned by the RenderFunc
+is ignored.
+*/
+func (c *CommandCompiler) Render(fn RenderFunc) {
+	c.state.template.addInstruction(&renderFunc{fn: fn, originalAttributes: c.originalAttributes})
+}
+
+/*
+RenderState provides access to the state of a template while it is being
+rendered.
+*/
+type RenderState struct {
+	rc                 *renderContext
+	originalAttributes attributesList
+}
+
+// Evaluate returns the value of a TALES expression in the current context.
+func (r *RenderState) Evaluate(expression string) interface{} {
+	return r.rc.talesContext.evaluate(expression, r.originalAttributes)
+}
+
+// Context returns the context.Context given to RenderContext.
+func (r *RenderState) Context() context.Context {
+	return r.rc.talesContext.ctx
+}
+
+/*
+Write writes data directly to the output of the template.  Errors are
+wrapped in a WriteError, and a LimitError is returned if the data would
+exceed the RenderMaxOutput limit.
+*/
+func (r *RenderState) Write(data []byte) (int, error) {
+	if err := r.rc.talesContext.limits.countOutput(len(data)); err != nil {
+		return 0, err
+	}
+	n, err := r.rc.out.Write(data)
+	if err != nil {
+		return n, &WriteError{Err: err}
+	}
+	return n, nil
+}
+
+/*
+renderFunc is a template instruction that executes a RenderFunc added by a
+Command.
+*/
+type renderFunc struct {
+	// fn is the function to execute
+	fn RenderFunc
+	// originalAttributes contains the non-TAL attributes of the original template
+	originalAttributes attributesList
+}
+
+/*
+render for a RenderFunc calls the function, discarding any value.
+*/
+func (d *renderFunc) render(rc *renderContext) error {
+	_, err := d.fn(&RenderState{rc: rc, originalAttributes: d.originalAttributes})
+	return err
+}
+
+// String returns a text description fo the instruction
+func (d *renderFunc) String() string {
+	return "[Render Func]"
+}
@@ -0,0 +1,112 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var errNoRole = errors.New("role missing")
+
+func init() {
+	// x:upper replaces the content with the upper case value of the expression.
+	RegisterCommand("x:upper", 7, func(c *CommandCompiler, value string) error {
+		c.ContentFunc(func(r *RenderState) (interface{}, error) {
+			return strings.ToUpper(fmt.Sprint(r.Evaluate(value))), nil
+		}, false)
+		return nil
+	})
+	// x:track adds analytics attributes.
+	RegisterCommand("x:track", 9, func(c *CommandCompiler, value string) error {
+		if value == "" {
+			return c.Error(ErrExpressionMissing)
+		}
+		c.Attribute("data-track", "string:"+c.TagName()+"-"+value)
+		return nil
+	})
+	// x:permission only shows the element if the user has the given role.
+	RegisterCommand("x:permission", 5, func(c *CommandCompiler, value string) error {
+		if value == "" {
+			return errNoRole
+		}
+		c.Condition("user/roles/" + value)
+		return nil
+	})
+	// x:banner writes a comment before the element.
+	RegisterCommand("x:banner", 20, func(c *CommandCompiler, value string) error {
+		c.Render(func(r *RenderState) (interface{}, error) {
+			_, err := r.Write([]byte("<!-- " + value + " -->"))
+			return nil, err
+		})
+		return nil
+	})
+}
+
+func TestRegisterCommandContentFunc(t *testing.T) {
+	runTest(t, talTest{
+		map[string]interface{}{"name": "Alice <admin>"},
+		`<body><h1 x:upper="name">Name</h1></body>`,
+		`<body><h1>ALICE &lt;ADMIN&gt;</h1></body>`,
+	})
+}
+
+func TestRegisterCommandAttribute(t *testing.T) {
+	runTest(t, talTest{
+		struct{}{},
+		`<body><a href="/" x:track="home">Home</a></body>`,
+		`<body><a href="/" data-track="a-home">Home</a></body>`,
+	})
+}
+
+func TestRegisterCommandCondition(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["user"] = map[string]interface{}{"roles": map[string]bool{"admin": true}}
+
+	runTest(t, talTest{
+		vals,
+		`<body><p x:permission="admin">Admin</p><p x:permission="editor">Editor</p></body>`,
+		`<body><p>Admin</p></body>`,
+	})
+}
+
+func TestRegisterCommandPriority(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["items"] = []string{"a", "b"}
+
+	runTest(t, talTest{
+		vals,
+		`<body><b x:upper="item" tal:repeat="item items" x:banner="item">Item</b></body>`,
+		`<body><!-- item --><b>A</b><!-- item --><b>B</b></body>`,
+	})
+}
+
+func TestRegisterCommandCompileError(t *testing.T) {
+	runCompileErrorTest(t, errTest{`<html><body x:track="">Hi</body></html>`, ErrExpressionMissing})
+	runCompileErrorTest(t, errTest{`<html><body x:permission="">Hi</body></html>`, ErrCommandFailed})
+
+	_, err := CompileTemplate(strings.NewReader(`<html><body x:permission="">Hi</body></html>`))
+	if !errors.Is(err, errNoRole) {
+		t.Errorf("Expected error from command to be wrapped, got %v", err)
+	}
+}
+
+func TestRegisterCommandInvalid(t *testing.T) {
+	noop := func(c *CommandCompiler, value string) error { return nil }
+	if err := RegisterCommand("x:upper", 1, noop); err == nil {
+		t.Errorf("Registering a duplicate command did not fail")
+	}
+	if err := RegisterCommand("tal:content", 1, noop); err == nil {
+		t.Errorf("Registering a built in command did not fail")
+	}
+	if err := RegisterCommand("noprefix", 1, noop); err == nil {
+		t.Errorf("Registering a command without a prefix did not fail")
+	}
+	if err := RegisterCommand("x:nil", 1, nil); err == nil {
+		t.Errorf("Registering a nil command did not fail")
+	}
+}
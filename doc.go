@@ -47,7 +47,7 @@ tal:condition makes output of an element conditional:
 
 Description:  If the expression evaluates to true then this tag and all its children will be output.  If the expression evaluates to false then this tag and all its children will not be included in the output.
 
-An expression is considered false if it is not found, evaluates to nil, is an empty string, is zero or is a boolean false.  All other values are treated as true.
+An expression is considered false if it is not found, evaluates to nil, is an empty string, is zero or is a boolean false.  All other values are treated as true.  See "Truth Values" for the full rules.
 
 Example:
 
@@ -122,9 +122,12 @@ Description:  Evaluates each "expression" and replaces the tag's attribute "name
 
 If the "expression" requires a semi-colon then it must be escaped by using ";;".
 
+Several attributes can be set at once by using "*" in place of the attribute name.  The expression must evaluate to a map with string keys (such as map[string]string) or a []html.Attribute.  Each entry is applied in turn using the same rules as above, so nil values remove attributes and boolean attributes are handled as normal.  Map entries are applied in key order.
+
 Example:
 
 	<a tal:attributes="href user/homepage;title user/fullname">Your Homepage</a>
+	<button tal:attributes="* widget/aria;id widget/id">Open</button>
 
 Omit Tag
 
@@ -140,11 +143,55 @@ Example:
 
 	<p><b tal:omit-tag="not:user/firstVisit">Welcome</b> to this page!</h1>
 
+Interpolation
+
+Text and attribute values in the template can include TALES expressions using the form ${expression}.  The expression is evaluated and the value is escaped and output in its place.  If the expression evaluates to nil or default nothing is output.  To output a literal "${" use "$${".
+
+Example:
+
+	<a href="/users/${user/id}">Profile for ${user/name}</a>
+
+Interpolated values are always escaped, so the structure keyword can not be used and results in a CompileError of type ErrInterpolationStructure.  Use tal:replace="structure ..." to output markup.  Expressions are not interpolated within raw text elements such as <script> and <style>.  Values set using tal:attributes take precedence over interpolated attribute values.  Interpolation can be disabled for templates that use ${ as literal text by passing CompileInterpolation(false) to CompileTemplate.
+
+Namespace Elements
+
+Elements in the tal and metal namespaces, such as <tal:block> and <metal:block>, are never included in the output, although their content is.  Attributes on these elements that do not have a namespace prefix are treated as commands in the namespace of the element, so the following are equivalent:
+
+	<tal:block repeat="item items"><b tal:content="item"></b></tal:block>
+	<tal:block tal:repeat="item items"><b tal:content="item"></b></tal:block>
+
+Namespace elements are useful for applying commands to a group of elements without introducing an extra element, e.g.
+
+	<metal:block define-macro="footer"><hr><p>Copyright</p></metal:block>
+
+Namespace Prefixes
+
+By default commands are recognised by the "tal:" and "metal:" attribute prefixes.  Other prefixes can be used for the same commands by declaring the TAL or METAL namespace using xmlns.  The declaration applies to the element it is on and all elements within it:
+
+	<div xmlns:t="http://xml.zope.org/namespaces/tal"><p t:content="title"></p></div>
+
+Prefixes can also be given when compiling the template using CompileNamespacePrefix.  This allows templates to use attribute names that are acceptable to HTML validators, such as data-tal-content:
+
+	tmpl, err := tal.CompileTemplate(in, tal.CompileNamespacePrefix("data-tal-", tal.TalNamespace), tal.CompileNamespacePrefix("data-metal-", tal.MetalNamespace))
+
+	<p data-tal-content="title"></p>
+
+Custom Commands
+
+New attribute commands can be added using RegisterCommand.  Each command has a name including a namespace prefix, a priority that determines when it is handled relative to other commands on the same element, and a Command function that is called when the attribute is found by CompileTemplate.  The Command uses the CommandCompiler to add behaviour to the element, such as conditions, content and attributes, or RenderFuncs that are executed during rendering.
+
+	tal.RegisterCommand("x:track", 9, func(c *tal.CommandCompiler, value string) error {
+		c.Attribute("data-track", "string:"+value)
+		return nil
+	})
+
+	<a href="/" x:track="home">Home</a>
+
 TALES Expressions
 
 The expressions used in TAL are called TALES expressions.  The simplest TALES expression is a path which references a value, e.g. page/body references the body property of the page object.  Objects are passed as the first argument of the Render method on a compiled template and must be either a struct, pointer to a struct or a map with strings as keys.
 
-The tal package does not support the python: and nocall: expression types.
+The tal package does not support the python: expression type.
 
 Path
 
@@ -158,12 +205,24 @@ Example:
 
 	<p tal:content="book/chapter/title | string:Untitled"></p>
 
+Each property in a path is looked for in the following order:
+
+    1. Types implementing TalesPath, TalesLookup or TalesValue are asked for the property
+    2. Struct fields, then struct methods
+    3. Methods of any other named type, such as "type Tags []string" or "type Cents int64"
+    4. Map keys
+    5. The argument of a function (see Path Arguments)
+    6. Built in properties (see Built In Properties)
+
+Struct fields and methods are only found if the property starts with an upper case letter.  Methods of other named types are also found using the property with its first letter in upper case, so tags/joined finds the Joined method.  Methods of a named map type take precedence over keys starting with an upper case letter, while keys starting with a lower case letter take precedence over methods.
+
 There are several built in variables that can be used in paths:
 
     nothing	- acts as nil in Go
     default	- keeps the existing value of the node (tag content or attribute value), the same value as tal.Default
     repeat	- access to repeat variables (see tal:repeat)
     attrs	- a dictionary of original attributes of the current tag
+    fmt	- locale formatting helpers (see Locale Formatting)
 
 Path Variables
 
@@ -177,6 +236,63 @@ Example:
 
 	<div tal:content="myMap/?loopValue"/>
 
+Built In Properties
+
+The following properties are available on values that do not have a field, key or method of the same name:
+
+    length	- the number of characters in a string, or items in a slice, array or map
+    empty	- true if a string, slice, array or map has no contents
+    upper	- a string in upper case
+    lower	- a string in lower case
+    trim	- a string with leading and trailing white space removed
+    capitalize	- a string with the first character in upper case
+    first	- the first item in a slice or array
+    last	- the last item in a slice or array
+    keys	- the keys of a map, sorted
+    abs	- the absolute value of a number
+
+Properties can be added, replaced or removed for a render using RenderProperty.
+
+Example:
+
+	<p tal:condition="not:basket/empty">${basket/length} items, starting with ${basket/first/name/capitalize}</p>
+
+Path Arguments
+
+If a path reaches a function that takes a single argument, the next part of the path is passed to the function as its argument.  String, numeric and boolean arguments are supported.
+
+Example:
+
+	<p tal:content="translate/greeting"></p>
+
+Request Context
+
+Templates rendered using RenderContext pass the context.Context to any function or method whose first parameter is a context.Context, so that cancellation and deadlines reach data loaded during rendering.  Any path argument follows the context:
+
+	func (u *User) Orders(ctx context.Context) ([]Order, error)
+	func (u *User) Order(ctx context.Context, id int) (Order, error)
+
+	<li tal:repeat="order user/Orders" tal:content="order/ID"></li>
+	<p tal:content="user/Order/42/Total"></p>
+
+Types can receive the context when resolving properties by implementing TalesValueContext.  Custom commands can get the context using RenderState.Context.
+
+If the context is cancelled or its deadline passes, rendering stops before the next iteration of a tal:repeat or the next macro or slot and RenderContext returns ctx.Err().
+
+Nocall
+
+nocall: Resolves a path without calling the final function or method.
+
+	Syntax: nocall:path
+
+Description: Functions and methods found at the end of a path are normally called, with the first returned value used as the result.  A nocall: path returns the function or method itself, allowing it to be defined as a variable and called later.  A variable that holds a function taking no arguments is called when the variable is used in a path.
+
+Example:
+
+	<div tal:define="greet nocall:user/Greeting">
+		<p tal:content="greet/Alice"></p>
+	</div>
+
 Exists
 
 exists: Tests whether a path exists.
@@ -189,6 +305,18 @@ Example:
 
 	<div tal:condition="exists:book">...</div>
 
+Truth Values
+
+tal:condition, tal:omit-tag, not: and boolean attributes all use the same rules to decide whether a value is true or false.  The following values are false:
+
+    - paths that are not found and nil values, including nil pointers, maps, slices and funcs
+    - boolean false
+    - zero numbers of any numeric type, including named types such as "type Cents int64"
+    - empty strings, slices, arrays and maps
+    - zero time.Time values
+
+All other values are true.  Types can decide their own truth value by implementing TalesBool.  Types implementing driver.Valuer, such as sql.NullInt64 and sql.NullString, use the truth value of the result of their Value method, so invalid (NULL) values are false.
+
 Not
 
 not: Returns the inverse boolean value of a path.
@@ -207,11 +335,84 @@ string: Basic string substitution
 
 	Syntax: string:text
 
-Description:  Evaluates to a string with value text while substituting variables with the form ${pathName} and $pathName
+Description:  Evaluates to a string with value text while substituting variables with the form ${pathName} and $pathName.  Use $$ to include a literal $.
+
+The ${pathName} form may include alternative paths separated by | and an optional format specifier:
+
+	${price:%.2f}               - formats the value using fmt.Sprintf and the given verb
+	${created:date:2006-01-02}  - formats a time.Time using the given layout (see time.Time.Format)
+
+Format specifiers can also be used with ${expression} interpolation in text and attributes.
+
+Example:
+
+	<b tal:content="string:Welcome ${user/nick | user/name}!"></b>
+	<b tal:content="string:Total ${order/total:%.2f} on ${order/date:date:2 Jan 2006}"></b>
+
+Sanitize
+
+sanitize: Removes unsafe markup from HTML.
+
+	Syntax: sanitize:tales-expression
+
+Description: Evaluates the expression and parses the result as HTML, keeping only the elements, attributes and URL schemes allowed by a SanitizePolicy.  Elements that are not allowed are removed but their text is kept, except for elements such as <script> and <style> which are removed entirely.  Comments are always removed.  The result is output by tal:content, tal:replace and ${expression} interpolation without escaping, and can be used even when a Policy does not allow structure.
+
+DefaultSanitizePolicy allows common formatting, lists, tables, links and images with http, https and mailto URLs.  Use RenderSanitizePolicy to choose a different policy:
+
+	policy := tal.DefaultSanitizePolicy()
+	policy.Elements["p"] = []string{"class"}
+	err := t.Render(data, out, tal.RenderSanitizePolicy(policy))
 
 Example:
 
-	<b tal:content="string:Welcome ${user/name}!"></b>
+	<div class="comment" tal:content="sanitize:comment/body"></div>
+
+JSON
+
+json: Converts a value to JSON.
+
+	Syntax: json:tales-expression
+
+Description: Evaluates the expression and converts the result to JSON using encoding/json.  The characters <, > and & and the line separators U+2028 and U+2029 are escaped, so the JSON is safe to output inside <script> elements.  tal:content and tal:replace output the JSON without escaping, without needing the structure keyword.  In attributes the JSON is escaped as usual.  Values that can not be converted stop the render with a *JSONError.  With RenderPolicy, the types of all values converted, their exported fields and any MarshalJSON or MarshalText methods must be allowed by the policy.
+
+Example:
+
+	<script tal:content="json:page/state"></script>
+	<div tal:attributes="data-options json:widget/options"></div>
+
+Formatting Values
+
+Values output by tal:content, tal:replace, tal:attributes, string: and ${expression} interpolation are converted to text by FormatValue.  Nil values and nil pointers are output as an empty string, []byte as text, time.Time in RFC 3339 format and floats without an exponent.  Types can control their own output by implementing TalesFormatter.
+
+A different Formatter can be given using RenderFormatter, for example to format numbers for a locale:
+
+	t.Render(data, out, tal.RenderFormatter(func(value interface{}) string {
+		if f, ok := value.(float64); ok {
+			return strings.Replace(strconv.FormatFloat(f, 'f', 2, 64), ".", ",", 1)
+		}
+		return tal.FormatValue(value)
+	}))
+
+Locale Formatting
+
+The fmt built in variable formats numbers and dates for the locale given using RenderLocale.  English (United States) is used if no locale is given.  Variables and data named fmt take precedence, so the helpers are only available if neither exists.
+
+	Syntax: fmt/helper/path
+
+Description: The path is evaluated and its value formatted by the helper:
+
+    number	- an integer or float with the locale's decimal and grouping separators, up to 3 decimal places
+    currency	- an amount in the locale's currency, or in the currency given as an ISO 4217 code, e.g. fmt/currency/EUR/price
+    date	- a time.Time as a short numeric date
+    longdate	- a time.Time as a date with the month name
+    time	- a time.Time as hours and minutes
+
+Rules are bundled for en-US, en-GB, de, fr, es, it, nl, pt-BR and ja.  Other regions use the rules for their language.  Values of the wrong type are returned unchanged.
+
+Example:
+
+	<td tal:content="fmt/currency/order/total"></td>
+	<td tal:content="string:Ordered on ${fmt/longdate/order/date}"></td>
 
 METAL Macro Language
 
@@ -243,6 +444,8 @@ Example:
 
 	<div metal:use-macro="macros/footer"></div>
 
+Macros can use themselves, for example to render a tree, as long as the recursion is ended by a tal:condition, tal:repeat or similar.  CompileTemplate returns an error of type ErrMacroRecursion if a macro always uses itself through literal macros/name paths.  When rendering, a macro can be used within itself 100 times before a MacroRecursionError naming the cycle of macros is returned.  The same limit applies to slot fillings that define the slot they fill.  The limit can be changed using RenderMaxMacroRecursion.
+
 Define Slot
 
 metal:define-slot creates a customisation point within a macro.
@@ -272,9 +475,49 @@ Example:
 		<i metal:fill-slot="Contact">Contact someone else</i>
 	</div>
 
+Render Limits
+
+Templates written by untrusted authors can be rendered with limits on the resources they use:
+
+	RenderMaxOutput		- the maximum number of bytes written
+	RenderMaxInstructions	- the maximum number of template instructions executed, including each iteration of a tal:repeat
+	RenderMaxDepth		- the maximum nesting of macros and slots
+	RenderTimeout		- the maximum wall time of the render
+
+A render that exceeds a limit stops and returns a *LimitError, whose Kind identifies the limit.  Output written before the limit was reached is not removed.
+
+Example:
+
+	err := t.Render(data, out, tal.RenderMaxOutput(1<<20), tal.RenderMaxDepth(10), tal.RenderTimeout(time.Second))
+
+Sandboxed Rendering
+
+RenderPolicy restricts which data a template can use.  A Policy is asked whether each type can be used, and whether each field or method can be used.  Sandbox is a Policy that allows only what has been explicitly allowed:
+
+	sandbox := tal.NewSandbox().
+		Allow(map[string]interface{}{}).
+		Allow(&Order{}, "Total", "Items")
+	err := t.Render(data, out, tal.RenderPolicy(sandbox))
+
+Struct fields can also be allowed with the struct tag `tal:"allow"`.  Maps, structs, functions and types with methods must be allowed before they are used, including the data passed to Render, values that are output or tested for truth, and the elements of slices and maps.  Other values, the built in variables and the built in properties are always allowed.  Structure is not allowed in tal:content and tal:replace unless the Structure field of the Sandbox is set.
+
+A render that uses data the policy does not allow stops and returns a *PolicyError.  Functions and methods that are not allowed are never called.
+
 Notes On HTML
 
 The tal package supports html5 output.  Void elements (such as <img>) are supported and will correctly suppress end tags.  Templates must have balanced start and end tags for non-void elements.  Even though HTML5 elements defines several elements as supporting optional end tags, for tal templates end tags must be provided.
 
+Inline SVG and MathML are supported, including TAL commands on their elements.  Element and attribute names within SVG and MathML are output in their canonical case (such as linearGradient and viewBox), and self-closing tags such as <path/> are kept.  Self-closing elements with TAL commands are given an end tag, as the commands may give them content.  Content within <foreignObject> is HTML.
+
+The content of raw text elements (such as <script> and <style>) and RCDATA elements (<textarea> and <title>) is output exactly as written in the template.  ${expression} interpolation is not carried out within raw text elements.  When tal:content or tal:replace sets the content of a raw text element, any "</" or "<!--" in the value is output as "<\/" or "<\!--" rather than being escaped as HTML, which keeps the meaning of JavaScript and CSS strings.  For RCDATA elements the value is escaped as usual.
+
+Comments, including conditional comments and server side include directives, are output exactly as written.  Comments starting with <!--! are template comments, which are removed when the template is compiled:
+
+	<!--! This note is not sent to users -->
+
+Other markup is normally rebuilt from its parsed form, so attribute values are always quoted, names are lower case, minimised attributes such as disabled are given an empty value, and character references such as &nbsp; are output as the characters they represent.  Passing CompilePreserveSource(true) to CompileTemplate outputs tags, text and attributes that are not changed by TAL commands exactly as written, which keeps the output close to the original markup:
+
+	tmpl, err := tal.CompileTemplate(in, tal.CompilePreserveSource(true))
+
 */
 package tal
@@ -6,6 +6,8 @@ package tal
 
 import (
 	"fmt"
+	"strings"
+	"time"
 )
 
 // CompileErrorKind indicates the kind of error encountered while compiling
@@ -21,6 +23,9 @@ type CompileError struct {
 	NextData string
 	// ErrorType specifies the kind of compilation error that has occured.
 	ErrorType CompileErrorKind
+	// Err holds the error returned by a registered Command for ErrCommandFailed,
+	// or a MacroRecursionError for ErrMacroRecursion.
+	Err error
 }
 
 // Error returns a text description of the compilation error.
@@ -37,12 +42,23 @@ func (err *CompileError) Error() string {
 		msg = "Parameters to tal command did not match specification."
 	case ErrExpressionMissing:
 		msg = "Expression missing from command"
+	case ErrCommandFailed:
+		msg = fmt.Sprintf("Command failed: %v", err.Err)
+	case ErrMacroRecursion:
+		msg = fmt.Sprintf("Recursive macro use: %v", err.Err)
+	case ErrInterpolationStructure:
+		msg = "structure can not be used in ${expression} interpolation"
 	default:
 		msg = "Unexpected error"
 	}
 	return fmt.Sprintf(`Tal compilation error (%v) at "%v" prior to "%v"\n`, msg, err.LastToken, err.NextData)
 }
 
+// Unwrap returns the underlying error, if any.
+func (err *CompileError) Unwrap() error {
+	return err.Err
+}
+
 const (
 	// ErrUnexpectedCloseTag is if a close tag is encountered for which an open tag was not seen.
 	ErrUnexpectedCloseTag CompileErrorKind = iota
@@ -54,6 +70,12 @@ const (
 	ErrExpressionMissing
 	// ErrSlotOutsideMacro is if a metal:fill-slot is outside of a use-macro.
 	ErrSlotOutsideMacro
+	// ErrCommandFailed is if a Command registered with RegisterCommand returned an error.
+	ErrCommandFailed
+	// ErrMacroRecursion is if a macro always uses itself, directly or through other macros.
+	ErrMacroRecursion
+	// ErrInterpolationStructure is if the structure keyword is used in ${expression} interpolation.
+	ErrInterpolationStructure
 )
 
 // Builds a new CompileError from the data provided.
@@ -64,3 +86,89 @@ func newCompileError(errType CompileErrorKind, lastToken []byte, nextData []byte
 	err.ErrorType = errType
 	return err
 }
+
+/*
+WriteError is returned by Render when writing to the io.Writer fails.
+
+Rendering stops at the first failed write.  Output written before the
+failure is not removed.
+*/
+type WriteError struct {
+	// Err is the error returned by the io.Writer.
+	Err error
+}
+
+// Error returns a text description of the write error.
+func (err *WriteError) Error() string {
+	return fmt.Sprintf("Tal render error writing output: %v", err.Err)
+}
+
+// Unwrap returns the error returned by the io.Writer.
+func (err *WriteError) Unwrap() error {
+	return err.Err
+}
+
+// LimitKind indicates which render limit was exceeded.
+type LimitKind int
+
+const (
+	// LimitOutput is if the output exceeded the RenderMaxOutput limit.
+	LimitOutput LimitKind = iota
+	// LimitInstructions is if the RenderMaxInstructions limit was exceeded.
+	LimitInstructions
+	// LimitDepth is if macros and slots were nested deeper than the RenderMaxDepth limit.
+	LimitDepth
+	// LimitTime is if the render took longer than the RenderTimeout limit.
+	LimitTime
+)
+
+/*
+LimitError is returned by Render if a limit set using RenderMaxOutput,
+RenderMaxInstructions, RenderMaxDepth or RenderTimeout is exceeded.
+*/
+type LimitError struct {
+	// Kind is the limit that was exceeded.
+	Kind LimitKind
+	// Limit is the value of the limit, in nanoseconds for LimitTime.
+	Limit int64
+}
+
+// Error returns a text description of the limit error.
+func (err *LimitError) Error() string {
+	var msg string
+	switch err.Kind {
+	case LimitOutput:
+		msg = fmt.Sprintf("output exceeded %v bytes", err.Limit)
+	case LimitInstructions:
+		msg = fmt.Sprintf("more than %v instructions executed", err.Limit)
+	case LimitDepth:
+		msg = fmt.Sprintf("macros and slots nested more than %v deep", err.Limit)
+	case LimitTime:
+		msg = fmt.Sprintf("render took longer than %v", time.Duration(err.Limit))
+	default:
+		msg = "unknown limit exceeded"
+	}
+	return fmt.Sprintf("Tal render limit exceeded: %v", msg)
+}
+
+/*
+MacroRecursionError is returned by Render if a macro, or the filling of a
+slot, is used within itself more times than the RenderMaxMacroRecursion
+limit, and is wrapped in a CompileError by CompileTemplate if a macro always
+uses itself.
+*/
+type MacroRecursionError struct {
+	// Chain holds the names of the macros and slots ("slot name") in the cycle, starting and ending with the repeated one.
+	Chain []string
+	// Limit is the recursion limit that was exceeded, or zero for a compilation error.
+	Limit int
+}
+
+// Error returns a text description of the macro recursion.
+func (err *MacroRecursionError) Error() string {
+	cycle := strings.Join(err.Chain, " -> ")
+	if err.Limit > 0 {
+		return fmt.Sprintf("Tal render error: macro used within itself more than %v times (%v)", err.Limit, cycle)
+	}
+	return cycle
+}
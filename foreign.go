@@ -0,0 +1,188 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+// The namespaces of foreign content - elements in HTML that are not HTML elements.
+const (
+	foreignSVG    = "svg"
+	foreignMathML = "math"
+)
+
+// svgTagNames maps lower case SVG element names onto their canonical case.
+var svgTagNames = map[string]string{
+	"altglyph":            "altGlyph",
+	"altglyphdef":         "altGlyphDef",
+	"altglyphitem":        "altGlyphItem",
+	"animatecolor":        "animateColor",
+	"animatemotion":       "animateMotion",
+	"animatetransform":    "animateTransform",
+	"clippath":            "clipPath",
+	"feblend":             "feBlend",
+	"fecolormatrix":       "feColorMatrix",
+	"fecomponenttransfer": "feComponentTransfer",
+	"fecomposite":         "feComposite",
+	"feconvolvematrix":    "feConvolveMatrix",
+	"fediffuselighting":   "feDiffuseLighting",
+	"fedisplacementmap":   "feDisplacementMap",
+	"fedistantlight":      "feDistantLight",
+	"fedropshadow":        "feDropShadow",
+	"feflood":             "feFlood",
+	"fefunca":             "feFuncA",
+	"fefuncb":             "feFuncB",
+	"fefuncg":             "feFuncG",
+	"fefuncr":             "feFuncR",
+	"fegaussianblur":      "feGaussianBlur",
+	"feimage":             "feImage",
+	"femerge":             "feMerge",
+	"femergenode":         "feMergeNode",
+	"femorphology":        "feMorphology",
+	"feoffset":            "feOffset",
+	"fepointlight":        "fePointLight",
+	"fespecularlighting":  "feSpecularLighting",
+	"fespotlight":         "feSpotLight",
+	"fetile":              "feTile",
+	"feturbulence":        "feTurbulence",
+	"foreignobject":       "foreignObject",
+	"glyphref":            "glyphRef",
+	"lineargradient":      "linearGradient",
+	"radialgradient":      "radialGradient",
+	"textpath":            "textPath",
+}
+
+// svgAttributeNames maps lower case SVG attribute names onto their canonical case.
+var svgAttributeNames = map[string]string{
+	"attributename":       "attributeName",
+	"attributetype":       "attributeType",
+	"basefrequency":       "baseFrequency",
+	"baseprofile":         "baseProfile",
+	"calcmode":            "calcMode",
+	"clippathunits":       "clipPathUnits",
+	"diffuseconstant":     "diffuseConstant",
+	"edgemode":            "edgeMode",
+	"filterunits":         "filterUnits",
+	"glyphref":            "glyphRef",
+	"gradienttransform":   "gradientTransform",
+	"gradientunits":       "gradientUnits",
+	"kernelmatrix":        "kernelMatrix",
+	"kernelunitlength":    "kernelUnitLength",
+	"keypoints":           "keyPoints",
+	"keysplines":          "keySplines",
+	"keytimes":            "keyTimes",
+	"lengthadjust":        "lengthAdjust",
+	"limitingconeangle":   "limitingConeAngle",
+	"markerheight":        "markerHeight",
+	"markerunits":         "markerUnits",
+	"markerwidth":         "markerWidth",
+	"maskcontentunits":    "maskContentUnits",
+	"maskunits":           "maskUnits",
+	"numoctaves":          "numOctaves",
+	"pathlength":          "pathLength",
+	"patterncontentunits": "patternContentUnits",
+	"patterntransform":    "patternTransform",
+	"patternunits":        "patternUnits",
+	"pointsatx":           "pointsAtX",
+	"pointsaty":           "pointsAtY",
+	"pointsatz":           "pointsAtZ",
+	"preservealpha":       "preserveAlpha",
+	"preserveaspectratio": "preserveAspectRatio",
+	"primitiveunits":      "primitiveUnits",
+	"refx":                "refX",
+	"refy":                "refY",
+	"repeatcount":         "repeatCount",
+	"repeatdur":           "repeatDur",
+	"requiredextensions":  "requiredExtensions",
+	"requiredfeatures":    "requiredFeatures",
+	"specularconstant":    "specularConstant",
+	"specularexponent":    "specularExponent",
+	"spreadmethod":        "spreadMethod",
+	"startoffset":         "startOffset",
+	"stddeviation":        "stdDeviation",
+	"stitchtiles":         "stitchTiles",
+	"surfacescale":        "surfaceScale",
+	"systemlanguage":      "systemLanguage",
+	"tablevalues":         "tableValues",
+	"targetx":             "targetX",
+	"targety":             "targetY",
+	"textlength":          "textLength",
+	"viewbox":             "viewBox",
+	"viewtarget":          "viewTarget",
+	"xchannelselector":    "xChannelSelector",
+	"ychannelselector":    "yChannelSelector",
+	"zoomandpan":          "zoomAndPan",
+}
+
+// mathMLAttributeNames maps lower case MathML attribute names onto their canonical case.
+var mathMLAttributeNames = map[string]string{
+	"definitionurl": "definitionURL",
+}
+
+// svgHTMLIntegrationPoints are the SVG elements whose content is HTML.
+var svgHTMLIntegrationPoints = map[string]bool{
+	"foreignobject": true,
+	"desc":          true,
+	"title":         true,
+}
+
+// mathMLTextIntegrationPoints are the MathML elements whose content is HTML.
+var mathMLTextIntegrationPoints = map[string]bool{
+	"mi":    true,
+	"mo":    true,
+	"mn":    true,
+	"ms":    true,
+	"mtext": true,
+}
+
+/*
+foreignNamespace returns the foreign content namespace of a new element with
+the given lower case name, or an empty string for HTML elements.
+*/
+func (state *compileState) foreignNamespace(tagName string) string {
+	foreign := ""
+	if len(state.tagStack) > 0 {
+		parent := state.tagStack[len(state.tagStack)-1]
+		foreign = parent.foreign
+		switch {
+		case foreign == foreignSVG && svgHTMLIntegrationPoints[string(parent.tag)]:
+			foreign = ""
+		case foreign == foreignMathML && mathMLTextIntegrationPoints[string(parent.tag)] && tagName != "mglyph" && tagName != "malignmark":
+			foreign = ""
+		}
+	}
+	if foreign == "" {
+		switch tagName {
+		case "svg":
+			return foreignSVG
+		case "math":
+			return foreignMathML
+		}
+	}
+	return foreign
+}
+
+// foreignTagName returns the name of an element in its canonical case.
+func foreignTagName(foreign string, tagName []byte) []byte {
+	if foreign == foreignSVG {
+		if name, ok := svgTagNames[string(tagName)]; ok {
+			return []byte(name)
+		}
+	}
+	return tagName
+}
+
+// foreignAttributeName returns the name of an attribute of a foreign element in its canonical case.
+func foreignAttributeName(foreign string, name string) string {
+	var adjusted string
+	var ok bool
+	switch foreign {
+	case foreignSVG:
+		adjusted, ok = svgAttributeNames[name]
+	case foreignMathML:
+		adjusted, ok = mathMLAttributeNames[name]
+	}
+	if ok {
+		return adjusted
+	}
+	return name
+}
@@ -0,0 +1,60 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"testing"
+)
+
+func TestSVGCase(t *testing.T) {
+	runTest(t, talTest{
+		nil,
+		`<svg viewBox="0 0 10 10" preserveAspectRatio="none"><defs><linearGradient id="g" gradientUnits="userSpaceOnUse"><stop offset="0"/></linearGradient></defs><rect width="10" height="10" fill="url(#g)"/></svg>`,
+		`<svg viewBox="0 0 10 10" preserveAspectRatio="none"><defs><linearGradient id="g" gradientUnits="userSpaceOnUse"><stop offset="0"/></linearGradient></defs><rect width="10" height="10" fill="url(#g)"/></svg>`,
+	})
+}
+
+func TestSVGCommands(t *testing.T) {
+	vals := map[string]interface{}{
+		"points": []string{"1,2", "3,4"},
+		"box":    "0 0 5 5",
+		"label":  "A & B",
+	}
+
+	runTest(t, talTest{
+		vals,
+		`<svg tal:attributes="viewbox box"><polyline tal:repeat="p points" tal:attributes="points p" pathLength="${repeat/p/number}"/><text tal:content="label"/><clipPath tal:condition="points" clipPathUnits="objectBoundingBox"></clipPath></svg>`,
+		`<svg viewBox="0 0 5 5"><polyline pathLength="1" points="1,2"></polyline><polyline pathLength="2" points="3,4"></polyline><text>A &amp; B</text><clipPath clipPathUnits="objectBoundingBox"></clipPath></svg>`,
+	})
+}
+
+func TestSVGIntegrationPoints(t *testing.T) {
+	runTest(t, talTest{
+		map[string]interface{}{"name": "<b>"},
+		`<svg><style>text { fill: red }</style><foreignObject><div viewBox="x"><br/><style>p > b {}</style></div></foreignObject><title tal:content="name"></title></svg><div viewbox="x"></div>`,
+		`<svg><style>text { fill: red }</style><foreignObject><div viewbox="x"><br><style>p > b {}</style></div></foreignObject><title>&lt;b&gt;</title></svg><div viewbox="x"></div>`,
+	})
+}
+
+func TestMathML(t *testing.T) {
+	runTest(t, talTest{
+		map[string]interface{}{"n": 2},
+		`<math definitionURL="x"><mi>x</mi><mn tal:content="n"></mn><mspace width="1em"/></math>`,
+		`<math definitionURL="x"><mi>x</mi><mn>2</mn><mspace width="1em"/></math>`,
+	})
+}
+
+func TestSelfClosingHTML(t *testing.T) {
+	runTest(t, talTest{
+		map[string]interface{}{"alt": "Logo"},
+		`<p>A<br/>B<img src="a.png" tal:attributes="alt alt"/><span/>C</p>`,
+		`<p>A<br>B<img src="a.png" alt="Logo"><span></span>C</p>`,
+	})
+	runCompileConfigTest(t, talTest{
+		nil,
+		`<p>A<br/><svg viewBox="0 0 1 1"><circle r="1" /></svg></p>`,
+		`<p>A<br/><svg viewBox="0 0 1 1"><circle r="1" /></svg></p>`,
+	}, []CompileConfig{CompilePreserveSource(true)})
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+/*
+TalesFormatter can be implemented by types that need to control how they are
+output by tal:content, tal:replace, tal:attributes, string: expressions and
+${expression} interpolation.
+*/
+type TalesFormatter interface {
+	// TalesFormat returns the text to output for the object.
+	TalesFormat() string
+}
+
+/*
+A Formatter converts a value into the text that is output by tal:content,
+tal:replace, tal:attributes, string: expressions and ${expression}
+interpolation.
+
+Escaping of the text is carried out after the Formatter has been called.
+*/
+type Formatter func(value interface{}) string
+
+/*
+RenderFormatter uses the given Formatter for all values output when rendering
+the template.
+
+The Formatter is called for every value.  To change the formatting of only
+some types, a Formatter can call FormatValue for all others.  A nil
+Formatter uses FormatValue.
+*/
+func RenderFormatter(formatter Formatter) RenderConfig {
+	if formatter == nil {
+		formatter = FormatValue
+	}
+	return func(t *Template, rc *renderContext) {
+		rc.talesContext.formatter = formatter
+	}
+}
+
+/*
+FormatValue is the Formatter used if RenderFormatter is not given.
+
+Values are converted as follows:
+
+	TalesFormatter       - the result of TalesFormat
+	nil and nil pointers - an empty string
+	[]byte               - the bytes as a string
+	time.Time            - RFC 3339 format
+	float32 and float64  - decimal notation without an exponent
+	Any other value      - fmt.Sprint
+*/
+func FormatValue(value interface{}) string {
+	if value == nil || value == notFound {
+		return ""
+	}
+	reflectValue := reflect.ValueOf(value)
+	if reflectValue.Kind() == reflect.Ptr && reflectValue.IsNil() {
+		return ""
+	}
+	switch a := value.(type) {
+	case TalesFormatter:
+		return a.TalesFormat()
+	case string:
+		return a
+	case []byte:
+		return string(a)
+	case time.Time:
+		return a.Format(time.RFC3339)
+	case *time.Time:
+		return a.Format(time.RFC3339)
+	case float32:
+		return strconv.FormatFloat(float64(a), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(a, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,71 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+type temperature float64
+
+func (t temperature) TalesFormat() string {
+	return fmt.Sprintf("%.1f°C", float64(t))
+}
+
+func TestFormatValueDefaults(t *testing.T) {
+	var nilTime *time.Time
+	vals := make(map[string]interface{})
+	vals["when"] = time.Date(2015, 3, 1, 12, 30, 0, 0, time.UTC)
+	vals["nilTime"] = nilTime
+	vals["ratio"] = 0.000001
+	vals["bytes"] = []byte("a<b")
+	vals["temp"] = temperature(21.25)
+
+	runTest(t, talTest{
+		vals,
+		`<p tal:content="when"></p><p tal:content="nilTime">x</p><p tal:content="ratio"></p><p tal:content="bytes"></p><p tal:content="temp"></p>`,
+		`<p>2015-03-01T12:30:00Z</p><p></p><p>0.000001</p><p>a&lt;b</p><p>21.2°C</p>`,
+	})
+}
+
+func TestFormatValueAttributesAndString(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["when"] = time.Date(2015, 3, 1, 12, 30, 0, 0, time.UTC)
+	vals["temp"] = temperature(-3)
+
+	runTest(t, talTest{
+		vals,
+		`<time tal:attributes="datetime when" tal:content="string:It was $temp at ${when}"></time>`,
+		`<time datetime="2015-03-01T12:30:00Z">It was -3.0°C at 2015-03-01T12:30:00Z</time>`,
+	})
+}
+
+func TestRenderFormatter(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["price"] = 1234.5
+	vals["name"] = "Widget"
+
+	comma := RenderFormatter(func(value interface{}) string {
+		if f, ok := value.(float64); ok {
+			return strings.Replace(fmt.Sprintf("%.2f", f), ".", ",", 1)
+		}
+		return FormatValue(value)
+	})
+
+	runTest(t, talTest{
+		vals,
+		`<p tal:attributes="data-price price" tal:content="string:$name costs ${price}">Price</p><b tal:replace="price"></b> ${price}`,
+		`<p data-price="1234,50">Widget costs 1234,50</p>1234,50 1234,50`,
+	}, comma)
+}
+
+func TestRenderFormatterNil(t *testing.T) {
+	vals := map[string]interface{}{"price": 1234.5}
+
+	runTest(t, talTest{vals, `<p tal:content="price"></p>${price}`, `<p>1234.5</p>1234.5`}, RenderFormatter(nil))
+}
@@ -4,6 +4,11 @@
 
 package tal
 
+import (
+	"strings"
+	"unicode"
+)
+
 var htmlVoidElements = map[string]bool{
 	"area":    true,
 	"base":    true,
@@ -23,6 +28,57 @@ var htmlVoidElements = map[string]bool{
 	"wbr":     true,
 }
 
+// htmlRawTextElements are the elements whose content is not parsed as HTML.
+var htmlRawTextElements = map[string]bool{
+	"iframe":   true,
+	"noembed":  true,
+	"noframes": true,
+	"noscript": true,
+	"script":   true,
+	"style":    true,
+	"xmp":      true,
+}
+
+// htmlRCDataElements are the elements whose content is text that can contain character references.
+var htmlRCDataElements = map[string]bool{
+	"textarea": true,
+	"title":    true,
+}
+
+// rawTextReplacer escapes text for use within raw text elements.
+var rawTextReplacer = strings.NewReplacer("</", `<\/`, "<!--", `<\!--`)
+
+/*
+escapeRawText makes text safe to output within a raw text element such as
+<script>, where character references can not be used.  A backslash is added
+after any < that could end the element or start a comment, which keeps the
+meaning of JavaScript and CSS strings.
+*/
+func escapeRawText(text string) string {
+	return rawTextReplacer.Replace(text)
+}
+
+/*
+validAttributeName returns true if the name can be output as an HTML
+attribute name.  Names must not be empty or contain whitespace, control
+characters, quotes, <, >, / or =.
+*/
+func validAttributeName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r <= ' ' || (r >= 0x7f && r <= 0x9f) || unicode.IsSpace(r) {
+			return false
+		}
+		switch r {
+		case '"', '\'', '>', '/', '=', '<':
+			return false
+		}
+	}
+	return true
+}
+
 var htmlBooleanAttributes = map[string]bool{
 	"allowFullscreen": true,
 	"async":           true,
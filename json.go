@@ -0,0 +1,160 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+/*
+JSONError is returned by Render if the value of a json: expression can not be
+converted to JSON.
+*/
+type JSONError struct {
+	// Expression is the TALES expression being evaluated.
+	Expression string
+	// Err is the error from encoding/json.
+	Err error
+}
+
+// Error returns a text description of the JSON error.
+func (err *JSONError) Error() string {
+	return fmt.Sprintf("Tal json error: %v in expression %q", err.Err, err.Expression)
+}
+
+// Unwrap returns the error from encoding/json.
+func (err *JSONError) Unwrap() error {
+	return err.Err
+}
+
+/*
+evaluateJSON implements TALES json: expressions.  The expression is evaluated
+and the result converted to JSON, so that it is output without further
+escaping.
+
+If a Policy is set, the value is checked by allowJSON before it is converted.
+
+encoding/json escapes <, >, &, U+2028 and U+2029, so the JSON can be used
+safely inside <script> elements.  In attributes the JSON is escaped as usual.
+*/
+func (t *tales) evaluateJSON(expression string) interface{} {
+	value := t.evaluateExpression(expression)
+	if value == Default {
+		return value
+	}
+	if t.policy != nil && !policyExempt(value) && !t.allowJSON(reflect.ValueOf(value), make(map[jsonVisit]bool)) {
+		return nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		t.debug("Unable to convert %v to JSON: %v\n", value, err)
+		if t.err == nil {
+			t.err = &JSONError{Expression: strings.TrimSpace(t.expression), Err: err}
+		}
+		return nil
+	}
+	return structureValue(encoded)
+}
+
+// jsonVisit identifies a pointer, map or slice already checked by allowJSON.
+type jsonVisit struct {
+	pointer uintptr
+	length  int
+	kind    reflect.Kind
+}
+
+/*
+allowJSON checks everything encoding/json would read from the value against
+the policy.  The types of all values, each exported struct field and any
+MarshalJSON or MarshalText method must be allowed.  If anything is not
+allowed, the error is recorded and false returned.
+*/
+func (t *tales) allowJSON(value reflect.Value, seen map[jsonVisit]bool) bool {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return true
+		}
+		if value.Kind() == reflect.Ptr {
+			visit := jsonVisit{value.Pointer(), 0, reflect.Ptr}
+			if seen[visit] {
+				// Cycles are reported by encoding/json.
+				return true
+			}
+			seen[visit] = true
+		}
+		value = value.Elem()
+	}
+	if !value.IsValid() {
+		return true
+	}
+	valueType := value.Type()
+	if !t.allowType(valueType) {
+		return false
+	}
+	for _, marshaler := range []struct {
+		iface  reflect.Type
+		method string
+	}{{jsonMarshalerType, "MarshalJSON"}, {textMarshalerType, "MarshalText"}} {
+		if valueType.Implements(marshaler.iface) || reflect.PtrTo(valueType).Implements(marshaler.iface) {
+			return t.allowProperty(valueType, marshaler.method)
+		}
+	}
+	switch value.Kind() {
+	case reflect.Map:
+		visit := jsonVisit{value.Pointer(), 0, reflect.Map}
+		if seen[visit] {
+			return true
+		}
+		seen[visit] = true
+		iter := value.MapRange()
+		for iter.Next() {
+			if !t.allowJSON(iter.Key(), seen) || !t.allowJSON(iter.Value(), seen) {
+				return false
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if elemType := valueType.Elem(); !policyChecked(elemType) && (elemType.Kind() <= reflect.Complex128 || elemType.Kind() == reflect.String) {
+			// Elements of basic types have nothing to check, so []byte is not walked.
+			return true
+		}
+		if value.Kind() == reflect.Slice {
+			visit := jsonVisit{value.Pointer(), value.Len(), reflect.Slice}
+			if seen[visit] {
+				return true
+			}
+			seen[visit] = true
+		}
+		for i := 0; i < value.Len(); i++ {
+			if !t.allowJSON(value.Index(i), seen) {
+				return false
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < valueType.NumField(); i++ {
+			field := valueType.Field(i)
+			fieldType := policyType(field.Type)
+			if field.PkgPath != "" && !(field.Anonymous && fieldType.Kind() == reflect.Struct) {
+				// Unexported fields are not read by encoding/json.
+				continue
+			}
+			if field.Tag.Get("json") == "-" {
+				continue
+			}
+			if !t.allowProperty(valueType, field.Name) || !t.allowJSON(value.Field(i), seen) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONScript(t *testing.T) {
+	vals := map[string]interface{}{
+		"state": map[string]interface{}{
+			"user":  "</script><script>alert('x & y')</script>",
+			"count": 2,
+			"lines": "a\u2028b\u2029c",
+		},
+	}
+
+	runTest(t, talTest{
+		vals,
+		`<script tal:content="json:state"></script>`,
+		`<script>{"count":2,"lines":"a\u2028b\u2029c","user":"\u003c/script\u003e\u003cscript\u003ealert('x \u0026 y')\u003c/script\u003e"}</script>`,
+	})
+	runTest(t, talTest{
+		vals,
+		`<p>${json:state/lines}</p>`,
+		`<p>"a\u2028b\u2029c"</p>`,
+	})
+}
+
+func TestJSONValues(t *testing.T) {
+	vals := map[string]interface{}{
+		"items": []string{"a", "b"},
+		"name":  `Say "hi"`,
+	}
+
+	runTest(t, talTest{vals, `<p tal:content="json:items"></p>`, `<p>["a","b"]</p>`})
+	runTest(t, talTest{vals, `<p tal:replace="json:nothing"></p>`, `null`})
+	runTest(t, talTest{vals, `<p tal:content="json:default">Kept</p>`, `<p>Kept</p>`})
+	// Attribute values are escaped as usual.
+	runTest(t, talTest{vals, `<div tal:attributes="data-name json:name"></div>`, `<div data-name="&#34;Say \&#34;hi\&#34;&#34;"></div>`})
+}
+
+func TestJSONError(t *testing.T) {
+	vals := map[string]interface{}{"channel": make(chan int)}
+	templ, err := CompileTemplate(strings.NewReader(`<p tal:content="json:channel"></p>`))
+	if err != nil {
+		t.Fatalf("Error compiling template: %v", err)
+	}
+	err = templ.Render(vals, &bytes.Buffer{})
+	var jsonErr *JSONError
+	if !errors.As(err, &jsonErr) {
+		t.Fatalf("Expected a JSONError, got %v", err)
+	}
+	if jsonErr.Error() != `Tal json error: json: unsupported type: chan int in expression "json:channel"` {
+		t.Errorf("Unexpected error message: %v", jsonErr)
+	}
+}
+
+type jsonUser struct {
+	Name         string `tal:"allow"`
+	PasswordHash string
+}
+
+type jsonSecret string
+
+func (s jsonSecret) MarshalJSON() ([]byte, error) {
+	return []byte(`"revealed"`), nil
+}
+
+func TestJSONSandbox(t *testing.T) {
+	vals := map[string]interface{}{
+		"user":   &jsonUser{Name: "a", PasswordHash: "secret"},
+		"users":  []interface{}{map[string]interface{}{"name": "b"}, jsonUser{Name: "c"}},
+		"secret": jsonSecret("hidden"),
+		"items":  []string{"a", "b"},
+	}
+	sandbox := NewSandbox().Allow(map[string]interface{}{})
+
+	policyErr := runPolicyErrorTest(t, `<script tal:content="json:user"></script>`, vals, sandbox)
+	if policyErr.Type != reflect.TypeOf(jsonUser{}) || policyErr.Property != "" {
+		t.Errorf("Expected the jsonUser type to be denied, got %v", policyErr)
+	}
+	runPolicyErrorTest(t, `<script tal:content="json:users"></script>`, vals, sandbox)
+	runPolicyErrorTest(t, `<script tal:content="json:secret"></script>`, vals, sandbox)
+	runTest(t, talTest{vals, `<script tal:content="json:items"></script>`, `<script>["a","b"]</script>`}, RenderPolicy(sandbox))
+
+	// All exported fields must be allowed, not just those tagged.
+	sandbox.Allow(jsonUser{})
+	policyErr = runPolicyErrorTest(t, `<script tal:content="json:user"></script>`, vals, sandbox)
+	if policyErr.Property != "PasswordHash" {
+		t.Errorf("Expected the PasswordHash field to be denied, got %v", policyErr)
+	}
+	sandbox.Allow(jsonUser{}, "PasswordHash")
+	runTest(t, talTest{vals, `<script tal:content="json:user"></script>`, `<script>{"Name":"a","PasswordHash":"secret"}</script>`}, RenderPolicy(sandbox))
+
+	// Methods used by encoding/json must be allowed.
+	sandbox.Allow(jsonSecret(""))
+	policyErr = runPolicyErrorTest(t, `<script tal:content="json:secret"></script>`, vals, sandbox)
+	if policyErr.Property != "MarshalJSON" {
+		t.Errorf("Expected MarshalJSON to be denied, got %v", policyErr)
+	}
+	sandbox.Allow(jsonSecret(""), "MarshalJSON")
+	runTest(t, talTest{vals, `<script tal:content="json:secret"></script>`, `<script>"revealed"</script>`}, RenderPolicy(sandbox))
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"time"
+)
+
+/*
+renderLimits holds the limits set for a render and the usage so far.
+
+A limit of zero means no limit.  The limits are held by the tales context so
+that they are shared by macros and slots rendered as subtemplates.
+*/
+type renderLimits struct {
+	// maxOutput is the maximum number of bytes written
+	maxOutput int64
+	output    int64
+	// maxInstructions is the maximum number of template instructions executed
+	maxInstructions int64
+	instructions    int64
+	// maxDepth is the maximum nesting of macros and slots
+	maxDepth int
+	depth    int
+	// timeout is the maximum wall time of the render, measured from deadline
+	timeout  time.Duration
+	deadline time.Time
+	// maxRecursion is the number of times a macro can be used within itself
+	maxRecursion int
+	// macroChain holds the macros currently being rendered, outermost first
+	macroChain []*Template
+}
+
+/*
+RenderMaxOutput limits the number of bytes a render can write.  A render
+that would exceed the limit stops with a LimitError of kind LimitOutput,
+before the output that would exceed the limit is written.
+*/
+func RenderMaxOutput(bytes int64) RenderConfig {
+	return func(t *Template, rc *renderContext) {
+		rc.talesContext.limits.maxOutput = bytes
+	}
+}
+
+/*
+RenderMaxInstructions limits the number of template instructions a render
+can execute, including each iteration of a tal:repeat.  A render that exceeds
+the limit stops with a LimitError of kind LimitInstructions.
+*/
+func RenderMaxInstructions(instructions int64) RenderConfig {
+	return func(t *Template, rc *renderContext) {
+		rc.talesContext.limits.maxInstructions = instructions
+	}
+}
+
+/*
+RenderMaxDepth limits how deeply macros and slots can be nested.  A render
+that exceeds the limit stops with a LimitError of kind LimitDepth.
+*/
+func RenderMaxDepth(depth int) RenderConfig {
+	return func(t *Template, rc *renderContext) {
+		rc.talesContext.limits.maxDepth = depth
+	}
+}
+
+/*
+RenderTimeout limits the wall time a render can take.  A render that takes
+longer stops at the next instruction with a LimitError of kind LimitTime.
+
+Time spent in a single function or method called by a path is not
+interrupted.  Use RenderContext for data lookups that should be cancelled.
+*/
+func RenderTimeout(timeout time.Duration) RenderConfig {
+	return func(t *Template, rc *renderContext) {
+		limits := &rc.talesContext.limits
+		limits.timeout = timeout
+		// The config is applied again for each macro - keep the original deadline.
+		if limits.deadline.IsZero() {
+			limits.deadline = time.Now().Add(timeout)
+		}
+	}
+}
+
+/*
+countInstruction is called before each instruction is executed and checks
+the instruction and time limits.
+*/
+func (l *renderLimits) countInstruction() error {
+	l.instructions++
+	if l.maxInstructions > 0 && l.instructions > l.maxInstructions {
+		return &LimitError{Kind: LimitInstructions, Limit: l.maxInstructions}
+	}
+	if l.timeout > 0 && time.Now().After(l.deadline) {
+		return &LimitError{Kind: LimitTime, Limit: int64(l.timeout)}
+	}
+	return nil
+}
+
+// countOutput checks that writing a number of bytes does not exceed the output limit.
+func (l *renderLimits) countOutput(bytes int) error {
+	if l.maxOutput > 0 && l.output+int64(bytes) > l.maxOutput {
+		return &LimitError{Kind: LimitOutput, Limit: l.maxOutput}
+	}
+	l.output += int64(bytes)
+	return nil
+}
+
+// enter is called when a macro or slot is rendered and checks the depth limit.
+func (l *renderLimits) enter() error {
+	if l.maxDepth > 0 && l.depth >= l.maxDepth {
+		return &LimitError{Kind: LimitDepth, Limit: int64(l.maxDepth)}
+	}
+	l.depth++
+	return nil
+}
+
+// leave is called when a macro or slot has been rendered.
+func (l *renderLimits) leave() {
+	l.depth--
+}
@@ -0,0 +1,95 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runLimitTest(t *testing.T, templateData string, data interface{}, kind LimitKind, cfg ...RenderConfig) string {
+	templ, err := CompileTemplate(strings.NewReader(templateData))
+	if err != nil {
+		t.Fatalf("Error compiling template: %v", err)
+	}
+	out := &bytes.Buffer{}
+	err = templ.Render(data, out, cfg...)
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("Expected a LimitError, got %v", err)
+	}
+	if limitErr.Kind != kind {
+		t.Errorf("Expected limit kind %v, got %v (%v)", kind, limitErr.Kind, limitErr)
+	}
+	return out.String()
+}
+
+func TestRenderMaxOutput(t *testing.T) {
+	vals := map[string]interface{}{"items": []string{"one", "two", "three"}}
+	tmpl := `<ul><li tal:repeat="item items" tal:content="item"></li></ul>`
+
+	out := runLimitTest(t, tmpl, vals, LimitOutput, RenderMaxOutput(20))
+	if out != `<ul><li>one</li><li>` {
+		t.Errorf("Expected output to stop at the limit, got %v", out)
+	}
+	if len(out) > 20 {
+		t.Errorf("Output of %v bytes exceeds the limit", len(out))
+	}
+
+	// A render within the limit succeeds.
+	runTest(t, talTest{vals, tmpl, `<ul><li>one</li><li>two</li><li>three</li></ul>`}, RenderMaxOutput(47))
+}
+
+func TestRenderMaxInstructions(t *testing.T) {
+	vals := map[string]interface{}{"items": make([]int, 1000)}
+	tmpl := `<ul><li tal:repeat="item items" tal:content="item"></li></ul>`
+
+	out := runLimitTest(t, tmpl, vals, LimitInstructions, RenderMaxInstructions(50))
+	if strings.Count(out, "<li>") > 25 {
+		t.Errorf("Expected rendering to stop after 50 instructions, got %v", out)
+	}
+}
+
+func TestRenderMaxDepth(t *testing.T) {
+	// The macro uses itself, so nests until the limit is reached.  The alternative
+	// path stops the recursion being detected when the template is compiled.
+	tmpl := `<div metal:define-macro="tree"><b>Node</b><div metal:use-macro="macros/tree | nothing"></div></div><p metal:use-macro="macros/tree"></p>`
+
+	out := runLimitTest(t, tmpl, nil, LimitDepth, RenderMaxDepth(5))
+	if strings.Count(out, "<b>Node</b>") != 6 {
+		t.Errorf("Expected the macro to be rendered 6 times, got %v", out)
+	}
+
+	// Slots count towards the depth.
+	slotTmpl := `<div metal:define-macro="page"><i metal:define-slot="body"></i></div><p metal:use-macro="macros/page"><b metal:fill-slot="body"><i metal:use-macro="macros/page"><u metal:fill-slot="body">Deep</u></i></b></p>`
+	runLimitTest(t, slotTmpl, nil, LimitDepth, RenderMaxDepth(3))
+	runTest(t, talTest{nil, slotTmpl, `<div><i></i></div><div><b><div><u>Deep</u></div></b></div>`}, RenderMaxDepth(4))
+}
+
+func TestRenderTimeout(t *testing.T) {
+	vals := map[string]interface{}{
+		"items": make([]int, 100),
+		"slow": func() string {
+			time.Sleep(2 * time.Millisecond)
+			return "slow"
+		},
+	}
+	tmpl := `<ul><li tal:repeat="item items" tal:content="slow"></li></ul>`
+
+	out := runLimitTest(t, tmpl, vals, LimitTime, RenderTimeout(10*time.Millisecond))
+	if strings.Count(out, "<li>") > 10 {
+		t.Errorf("Expected rendering to stop after the timeout, got %v", out)
+	}
+}
+
+func TestLimitErrorMessage(t *testing.T) {
+	err := &LimitError{Kind: LimitTime, Limit: int64(time.Second)}
+	if err.Error() != "Tal render limit exceeded: render took longer than 1s" {
+		t.Errorf("Unexpected error message: %v", err)
+	}
+}
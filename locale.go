@@ -0,0 +1,332 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// formatHelpersRoot is the built in path variable that provides the locale formatting helpers.
+const formatHelpersRoot = "fmt"
+
+// englishMonths holds the month names produced by time.Time.Format.
+var englishMonths = []string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"}
+
+/*
+localeRules holds the formatting conventions for a locale.
+*/
+type localeRules struct {
+	// decimal is the decimal separator
+	decimal string
+	// group is the thousands separator
+	group string
+	// minGrouping is the minimum number of integer digits before grouping is used
+	minGrouping int
+	// currency is the default ISO 4217 currency code
+	currency string
+	// symbolFirst is true if the currency symbol comes before the number
+	symbolFirst bool
+	// symbolSpace separates the currency symbol and the number
+	symbolSpace string
+	// symbols overrides the default currency symbols for this locale
+	symbols map[string]string
+	// date, longDate and time are time.Time layouts
+	date     string
+	longDate string
+	time     string
+	// months holds the month names used in longDate, if not English
+	months []string
+}
+
+// currencySymbols holds the symbol used for common currencies.
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+	"JPY": "¥",
+	"BRL": "R$",
+	"CHF": "CHF",
+	"CAD": "CA$",
+	"AUD": "A$",
+}
+
+// currencyDecimals holds the number of decimal places for currencies that don't use 2.
+var currencyDecimals = map[string]int{
+	"JPY": 0,
+}
+
+// defaultLocale is used if no locale is given using RenderLocale.
+const defaultLocale = "en"
+
+// locales holds the bundled locale rules, keyed by lower case language tag.
+var locales = map[string]*localeRules{
+	"en": {
+		decimal: ".", group: ",", minGrouping: 1, currency: "USD", symbolFirst: true,
+		date: "1/2/2006", longDate: "January 2, 2006", time: "3:04 PM",
+	},
+	"en-gb": {
+		decimal: ".", group: ",", minGrouping: 1, currency: "GBP", symbolFirst: true,
+		date: "02/01/2006", longDate: "2 January 2006", time: "15:04",
+	},
+	"de": {
+		decimal: ",", group: ".", minGrouping: 1, currency: "EUR", symbolSpace: "\u00a0",
+		date: "02.01.2006", longDate: "2. January 2006", time: "15:04",
+		months: []string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+	},
+	"fr": {
+		decimal: ",", group: "\u202f", minGrouping: 1, currency: "EUR", symbolSpace: "\u00a0",
+		date: "02/01/2006", longDate: "2 January 2006", time: "15:04",
+		months: []string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+	},
+	"es": {
+		decimal: ",", group: ".", minGrouping: 2, currency: "EUR", symbolSpace: "\u00a0",
+		date: "2/1/2006", longDate: "2 de January de 2006", time: "15:04",
+		months: []string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+	},
+	"it": {
+		decimal: ",", group: ".", minGrouping: 1, currency: "EUR", symbolSpace: "\u00a0",
+		date: "02/01/2006", longDate: "2 January 2006", time: "15:04",
+		months: []string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+	},
+	"nl": {
+		decimal: ",", group: ".", minGrouping: 1, currency: "EUR", symbolFirst: true, symbolSpace: "\u00a0",
+		date: "02-01-2006", longDate: "2 January 2006", time: "15:04",
+		months: []string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+	},
+	"pt": {
+		decimal: ",", group: ".", minGrouping: 1, currency: "BRL", symbolFirst: true, symbolSpace: "\u00a0",
+		date: "02/01/2006", longDate: "2 de January de 2006", time: "15:04",
+		months: []string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+	},
+	"ja": {
+		decimal: ".", group: ",", minGrouping: 1, currency: "JPY", symbolFirst: true,
+		date: "2006/01/02", longDate: "2006年1月2日", time: "15:04",
+		symbols: map[string]string{"JPY": "￥"},
+	},
+}
+
+func init() {
+	// Regional variants that share the rules of another locale.
+	locales["en-us"] = locales["en"]
+	locales["de-de"] = locales["de"]
+	locales["fr-fr"] = locales["fr"]
+	locales["es-es"] = locales["es"]
+	locales["it-it"] = locales["it"]
+	locales["nl-nl"] = locales["nl"]
+	locales["pt-br"] = locales["pt"]
+	locales["ja-jp"] = locales["ja"]
+}
+
+/*
+findLocale returns the rules for a language tag such as "de-DE" or "pt_BR".
+
+If there are no rules for the region the rules of the language are used, and
+if there are none for the language the default locale is used.
+*/
+func findLocale(tag string) *localeRules {
+	tag = strings.ToLower(strings.Replace(tag, "_", "-", -1))
+	if rules, ok := locales[tag]; ok {
+		return rules
+	}
+	if end := strings.Index(tag, "-"); end > -1 {
+		if rules, ok := locales[tag[:end]]; ok {
+			return rules
+		}
+	}
+	return locales[defaultLocale]
+}
+
+/*
+RenderLocale sets the locale used by the fmt/ path helpers, for example
+"en-US", "en-GB", "de", "fr", "es", "it", "nl", "pt-BR" or "ja".
+
+Unknown regions fall back to the rules for the language, and unknown
+languages to English (United States).
+*/
+func RenderLocale(tag string) RenderConfig {
+	return func(t *Template, rc *renderContext) {
+		rc.talesContext.locale = findLocale(tag)
+	}
+}
+
+/*
+evaluateFormatHelper evaluates a path of the form fmt/helper/path.  The path
+is resolved and the resulting value formatted for the current locale.
+
+The currency helper accepts an optional ISO 4217 currency code before the
+path, e.g. fmt/currency/EUR/price.
+*/
+func (t *tales) evaluateFormatHelper(pathElements []string, call bool) interface{} {
+	if len(pathElements) < 3 {
+		return notFound
+	}
+	rules := t.locale
+	if rules == nil {
+		rules = locales[defaultLocale]
+	}
+	helper, path := pathElements[1], pathElements[2:]
+	currency := rules.currency
+	if helper == "currency" && len(path) > 1 {
+		if _, ok := currencySymbols[path[0]]; ok {
+			currency, path = path[0], path[1:]
+		}
+	}
+	value := t.evaluateSinglePath(strings.Join(path, "/"), call)
+	if value == nil || value == notFound {
+		return value
+	}
+
+	switch helper {
+	case "number":
+		if number, integer, ok := numericValue(value); ok {
+			if integer != "" {
+				return rules.formatNumber(number, integer, 0)
+			}
+			return strings.TrimRight(strings.TrimRight(rules.formatNumber(number, integer, 3), "0"), rules.decimal)
+		}
+	case "currency":
+		if number, integer, ok := numericValue(value); ok {
+			return rules.formatCurrency(number, integer, currency)
+		}
+	case "date", "longdate", "time":
+		when, ok := value.(time.Time)
+		if whenPtr, isPtr := value.(*time.Time); isPtr && whenPtr != nil {
+			when, ok = *whenPtr, true
+		}
+		if !ok {
+			return value
+		}
+		switch helper {
+		case "date":
+			return when.Format(rules.date)
+		case "time":
+			return when.Format(rules.time)
+		}
+		formatted := when.Format(rules.longDate)
+		if rules.months != nil {
+			formatted = strings.Replace(formatted, englishMonths[when.Month()-1], rules.months[when.Month()-1], 1)
+		}
+		return formatted
+	default:
+		return notFound
+	}
+	return value
+}
+
+/*
+numericValue converts any float kind into a float64.  For integer kinds the
+decimal digits are returned as integer instead, so that no precision is lost.
+*/
+func numericValue(value interface{}) (number float64, integer string, ok bool) {
+	reflectValue := reflect.ValueOf(value)
+	switch reflectValue.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return 0, strconv.FormatInt(reflectValue.Int(), 10), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return 0, strconv.FormatUint(reflectValue.Uint(), 10), true
+	case reflect.Float32, reflect.Float64:
+		return reflectValue.Float(), "", true
+	}
+	return 0, "", false
+}
+
+/*
+formatNumber formats a number from numericValue with the given number of
+decimal places using the separators of the locale.  NaN is formatted as "NaN"
+and infinity as "∞".
+*/
+func (l *localeRules) formatNumber(number float64, integer string, decimals int) string {
+	if integer == "" && math.IsNaN(number) {
+		return "NaN"
+	}
+	amount, negative := l.formatAmount(number, integer, decimals)
+	if negative {
+		return "-" + amount
+	}
+	return amount
+}
+
+/*
+formatAmount formats the absolute value of a number from numericValue, and
+reports whether the number is negative once rounded.  Numbers that round to
+zero are never negative.
+*/
+func (l *localeRules) formatAmount(number float64, integer string, decimals int) (amount string, negative bool) {
+	var digits string
+	if integer != "" {
+		negative = integer[0] == '-'
+		digits = strings.TrimPrefix(integer, "-")
+		if decimals > 0 {
+			digits += "." + strings.Repeat("0", decimals)
+		}
+	} else {
+		if math.IsInf(number, 0) {
+			return "∞", number < 0
+		}
+		// Round half away from zero, as is usual for displayed amounts.  Halves in
+		// the shortest decimal form of the number are moved up by the smallest step,
+		// as FormatFloat rounds exact halves to even.
+		absolute := math.Abs(number)
+		if shortest := strconv.FormatFloat(absolute, 'f', -1, 64); strings.HasSuffix(shortest, "5") {
+			if point := strings.IndexByte(shortest, '.'); point >= 0 && len(shortest)-point-1 == decimals+1 {
+				absolute = math.Nextafter(absolute, math.Inf(1))
+			}
+		}
+		digits = strconv.FormatFloat(absolute, 'f', decimals, 64)
+		negative = number < 0 && strings.Trim(digits, "0.") != ""
+	}
+	integerPart, fraction := digits, ""
+	if decimals > 0 {
+		integerPart, fraction = digits[:len(digits)-decimals-1], digits[len(digits)-decimals:]
+	}
+	if len(integerPart) > 3+l.minGrouping-1 {
+		grouped := integerPart[:len(integerPart)%3]
+		for i := len(integerPart) % 3; i < len(integerPart); i += 3 {
+			if grouped != "" {
+				grouped += l.group
+			}
+			grouped += integerPart[i : i+3]
+		}
+		integerPart = grouped
+	}
+	if fraction != "" {
+		return integerPart + l.decimal + fraction, negative
+	}
+	return integerPart, negative
+}
+
+/*
+formatCurrency formats an amount of the given currency using the conventions
+of the locale.
+*/
+func (l *localeRules) formatCurrency(number float64, integer string, currency string) string {
+	decimals, ok := currencyDecimals[currency]
+	if !ok {
+		decimals = 2
+	}
+	symbol, ok := l.symbols[currency]
+	if !ok {
+		symbol, ok = currencySymbols[currency]
+	}
+	if !ok {
+		symbol = currency
+	}
+	if integer == "" && math.IsNaN(number) {
+		return "NaN"
+	}
+	amount, negative := l.formatAmount(number, integer, decimals)
+	sign := ""
+	if negative {
+		sign = "-"
+	}
+	if l.symbolFirst {
+		return sign + symbol + l.symbolSpace + amount
+	}
+	return sign + amount + l.symbolSpace + symbol
+}
@@ -0,0 +1,172 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func localeTestData() map[string]interface{} {
+	vals := make(map[string]interface{})
+	vals["total"] = 1234567.891
+	vals["count"] = 12345
+	vals["small"] = 1234
+	vals["price"] = 1234.5
+	vals["when"] = time.Date(2015, 3, 1, 14, 5, 0, 0, time.UTC)
+	return vals
+}
+
+const localeTestTemplate = `<p tal:content="fmt/number/total"></p><p tal:content="fmt/number/count"></p><p tal:content="fmt/number/small"></p><p tal:content="fmt/currency/price"></p><p tal:content="fmt/date/when"></p><p tal:content="fmt/longdate/when"></p><p tal:content="fmt/time/when"></p>`
+
+func TestLocaleDefault(t *testing.T) {
+	runTest(t, talTest{
+		localeTestData(),
+		localeTestTemplate,
+		`<p>1,234,567.891</p><p>12,345</p><p>1,234</p><p>$1,234.50</p><p>3/1/2015</p><p>March 1, 2015</p><p>2:05 PM</p>`,
+	})
+}
+
+func TestLocaleEnglishGB(t *testing.T) {
+	runTest(t, talTest{
+		localeTestData(),
+		localeTestTemplate,
+		`<p>1,234,567.891</p><p>12,345</p><p>1,234</p><p>£1,234.50</p><p>01/03/2015</p><p>1 March 2015</p><p>14:05</p>`,
+	}, RenderLocale("en-GB"))
+}
+
+func TestLocaleGerman(t *testing.T) {
+	runTest(t, talTest{
+		localeTestData(),
+		localeTestTemplate,
+		"<p>1.234.567,891</p><p>12.345</p><p>1.234</p><p>1.234,50\u00a0€</p><p>01.03.2015</p><p>1. März 2015</p><p>14:05</p>",
+	}, RenderLocale("de-DE"))
+}
+
+func TestLocaleFrench(t *testing.T) {
+	runTest(t, talTest{
+		localeTestData(),
+		localeTestTemplate,
+		"<p>1\u202f234\u202f567,891</p><p>12\u202f345</p><p>1\u202f234</p><p>1\u202f234,50\u00a0€</p><p>01/03/2015</p><p>1 mars 2015</p><p>14:05</p>",
+	}, RenderLocale("fr"))
+}
+
+func TestLocaleSpanish(t *testing.T) {
+	runTest(t, talTest{
+		localeTestData(),
+		localeTestTemplate,
+		"<p>1.234.567,891</p><p>12.345</p><p>1234</p><p>1234,50\u00a0€</p><p>1/3/2015</p><p>1 de marzo de 2015</p><p>14:05</p>",
+	}, RenderLocale("es"))
+}
+
+func TestLocaleBrazil(t *testing.T) {
+	runTest(t, talTest{
+		localeTestData(),
+		localeTestTemplate,
+		"<p>1.234.567,891</p><p>12.345</p><p>1.234</p><p>R$\u00a01.234,50</p><p>01/03/2015</p><p>1 de março de 2015</p><p>14:05</p>",
+	}, RenderLocale("pt_BR"))
+}
+
+func TestLocaleJapanese(t *testing.T) {
+	runTest(t, talTest{
+		localeTestData(),
+		localeTestTemplate,
+		`<p>1,234,567.891</p><p>12,345</p><p>1,234</p><p>￥1,235</p><p>2015/03/01</p><p>2015年3月1日</p><p>14:05</p>`,
+	}, RenderLocale("ja-JP"))
+}
+
+func TestLocaleCurrencyCode(t *testing.T) {
+	vals := localeTestData()
+	vals["debt"] = -42
+
+	runTest(t, talTest{
+		vals,
+		`<p tal:content="fmt/currency/USD/price"></p><p tal:content="fmt/currency/EUR/debt"></p><p tal:content="fmt/currency/JPY/price"></p>`,
+		"<p>1.234,50\u00a0$</p><p>-42,00\u00a0€</p><p>1.235\u00a0¥</p>",
+	}, RenderLocale("it"))
+}
+
+func TestLocaleMissingAndUnknown(t *testing.T) {
+	vals := localeTestData()
+	vals["name"] = "Alice"
+
+	runTest(t, talTest{
+		vals,
+		`<p tal:content="fmt/number/missing | string:none"></p><p tal:content="fmt/number/name"></p><p tal:content="fmt/unknown/total | string:unknown"></p><p tal:content="fmt/number/total"></p>`,
+		`<p>none</p><p>Alice</p><p>unknown</p><p>1,234,567.891</p>`,
+	}, RenderLocale("xx-YY"))
+}
+
+func TestLocaleInString(t *testing.T) {
+	runTest(t, talTest{
+		localeTestData(),
+		`<p tal:content="string:Total ${fmt/currency/price} on ${fmt/date/when}"></p>`,
+		"<p>Total €\u00a01.234,50 on 01-03-2015</p>",
+	}, RenderLocale("nl"))
+}
+
+func TestLocaleSpecialNumbers(t *testing.T) {
+	vals := map[string]interface{}{
+		"nan":   math.NaN(),
+		"inf":   math.Inf(1),
+		"ninf":  math.Inf(-1),
+		"large": 1e20,
+		"tie":   2.675,
+		"half":  0.125,
+	}
+
+	runTest(t, talTest{
+		vals,
+		`<p tal:content="fmt/number/nan"></p><p tal:content="fmt/currency/nan"></p><p tal:content="fmt/number/inf"></p><p tal:content="fmt/currency/ninf"></p><p tal:content="fmt/number/large"></p><p tal:content="fmt/currency/large"></p><p tal:content="fmt/currency/tie"></p><p tal:content="fmt/number/half"></p>`,
+		"<p>NaN</p><p>NaN</p><p>∞</p><p>-∞\u00a0€</p><p>100.000.000.000.000.000.000</p><p>100.000.000.000.000.000.000,00\u00a0€</p><p>2,68\u00a0€</p><p>0,125</p>",
+	}, RenderLocale("de-DE"))
+}
+
+func TestLocaleLargeIntegers(t *testing.T) {
+	vals := map[string]interface{}{
+		"int":    int64(9007199254740993),
+		"min":    int64(math.MinInt64),
+		"uint":   uint64(math.MaxUint64),
+		"amount": int64(-9007199254740993),
+	}
+
+	runTest(t, talTest{
+		vals,
+		`<p tal:content="fmt/number/int"></p><p tal:content="fmt/number/min"></p><p tal:content="fmt/number/uint"></p><p tal:content="fmt/currency/amount"></p>`,
+		"<p>9.007.199.254.740.993</p><p>-9.223.372.036.854.775.808</p><p>18.446.744.073.709.551.615</p><p>-9.007.199.254.740.993,00\u00a0€</p>",
+	}, RenderLocale("de-DE"))
+}
+
+func TestLocaleRoundedToZero(t *testing.T) {
+	vals := map[string]interface{}{
+		"tiny":   -0.001,
+		"tinier": -0.0001,
+		"half":   -0.005,
+		"zero":   math.Copysign(0, -1),
+	}
+
+	runTest(t, talTest{
+		vals,
+		`<p tal:content="fmt/currency/tiny"></p><p tal:content="fmt/number/tinier"></p><p tal:content="fmt/number/zero"></p><p tal:content="fmt/currency/half"></p>`,
+		"<p>0,00\u00a0€</p><p>0</p><p>0</p><p>-0,01\u00a0€</p>",
+	}, RenderLocale("de-DE"))
+}
+
+func TestLocaleShadowed(t *testing.T) {
+	vals := localeTestData()
+	vals["fmt"] = map[string]interface{}{"name": "Data"}
+
+	runTest(t, talTest{
+		vals,
+		`<p tal:content="fmt/name"></p><p tal:define="fmt string:Local" tal:content="fmt"></p><p tal:content="fmt/number/total | string:none"></p>`,
+		`<p>Data</p><p>Local</p><p>none</p>`,
+	})
+	runTest(t, talTest{
+		localeTestData(),
+		`<p tal:define="global fmt string:Global"></p><p tal:content="fmt"></p>`,
+		`<p></p><p>Global</p>`,
+	})
+}
@@ -5,6 +5,8 @@
 package tal
 
 import (
+	"bytes"
+	"errors"
 	"strings"
 	"testing"
 )
@@ -141,3 +143,79 @@ func TestMetalSlotsOnVoidElement(t *testing.T) {
 		`<html><body><div>Hi <i>I here</i> There <b>Default Person</b> there.</div> or <div>Hi <img src="alt image"> There <b>Default Person</b> there.</div></body></html>`,
 	})
 }
+
+func TestMetalRecursiveMacroCompileError(t *testing.T) {
+	runCompileErrorTest(t, errTest{`<div metal:define-macro="loop">Loop <b metal:use-macro="macros/loop"></b></div>`, ErrMacroRecursion})
+	runCompileErrorTest(t, errTest{`<div metal:define-macro="a"><p metal:use-macro="path:macros/b"></p></div><div metal:define-macro="b"><span><p metal:use-macro="macros/a"></p></span></div>`, ErrMacroRecursion})
+
+	_, err := CompileTemplate(strings.NewReader(`<div metal:define-macro="a"><p metal:use-macro="macros/b"></p></div><div metal:define-macro="b"><p metal:use-macro="macros/c"></p></div><div metal:define-macro="c"><p metal:use-macro="macros/b"></p></div>`))
+	var recursionErr *MacroRecursionError
+	if !errors.As(err, &recursionErr) {
+		t.Fatalf("Expected a MacroRecursionError, got %v", err)
+	}
+	if strings.Join(recursionErr.Chain, " -> ") != "b -> c -> b" {
+		t.Errorf("Expected the cycle b -> c -> b, got %v", recursionErr.Chain)
+	}
+}
+
+func TestMetalConditionalRecursiveMacro(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["next"] = map[string]interface{}{
+		"name": "one",
+		"next": map[string]interface{}{
+			"name": "two",
+			"next": map[string]interface{}{"name": "three"},
+		},
+	}
+
+	// Recursion that depends on the data is allowed.
+	runTalesTest(t, talesTest{
+		vals,
+		`<ol metal:define-macro="item" tal:define="item next"><li tal:content="item/name"></li><i tal:condition="item/next" tal:define="next item/next" tal:omit-tag=""><ol metal:use-macro="macros/item"></ol></i></ol>`,
+		`<ol><li>one</li><ol><li>two</li><ol><li>three</li></ol></ol></ol>`,
+	})
+}
+
+func TestMetalRecursiveSlotRenderError(t *testing.T) {
+	// The slot filling defines the slot it fills, so would fill itself forever.
+	templ, err := CompileTemplate(strings.NewReader(`<div metal:define-macro="m"><p metal:define-slot="s">default</p></div><div metal:use-macro="macros/m"><b metal:fill-slot="s"><i metal:define-slot="s">x</i></b></div>`))
+	if err != nil {
+		t.Fatalf("Error compiling template: %v", err)
+	}
+	err = templ.Render(nil, &bytes.Buffer{}, RenderMaxMacroRecursion(5))
+	var recursionErr *MacroRecursionError
+	if !errors.As(err, &recursionErr) {
+		t.Fatalf("Expected a MacroRecursionError, got %v", err)
+	}
+	if strings.Join(recursionErr.Chain, " -> ") != "slot s -> slot s" || recursionErr.Limit != 5 {
+		t.Errorf("Unexpected recursion error %v", recursionErr)
+	}
+
+	err = templ.Render(nil, &bytes.Buffer{})
+	if !errors.As(err, &recursionErr) {
+		t.Fatalf("Expected a MacroRecursionError with the default limit, got %v", err)
+	}
+}
+
+func TestMetalRecursiveMacroRenderError(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["forever"] = true
+	templ, err := CompileTemplate(strings.NewReader(`<div metal:define-macro="outer"><p metal:use-macro="macros/inner"></p></div><div metal:define-macro="inner"><b tal:condition="forever"><p metal:use-macro="macros/outer"></p></b></div><div metal:use-macro="macros/outer"></div>`))
+	if err != nil {
+		t.Fatalf("Error compiling template: %v", err)
+	}
+	for _, cfg := range []RenderConfig{RenderMaxMacroRecursion(3), RenderDebugLogging(func(string, ...interface{}) {})} {
+		err = templ.Render(vals, &bytes.Buffer{}, cfg)
+		var recursionErr *MacroRecursionError
+		if !errors.As(err, &recursionErr) {
+			t.Fatalf("Expected a MacroRecursionError, got %v", err)
+		}
+		// The definition of outer is rendered first, so inner is the first macro used.
+		if strings.Join(recursionErr.Chain, " -> ") != "inner -> outer -> inner" {
+			t.Errorf("Expected the cycle inner -> outer -> inner, got %v", recursionErr.Chain)
+		}
+	}
+	if err.(*MacroRecursionError).Limit != defaultMaxMacroRecursion {
+		t.Errorf("Expected the default limit to be used, got %v", err)
+	}
+}
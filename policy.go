@@ -0,0 +1,245 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+/*
+A Policy decides which parts of the data a template can access.  Policies are
+used with RenderPolicy when rendering templates written by untrusted authors.
+
+Types are passed to a Policy with any pointers removed, so a policy for T
+also applies to *T.
+*/
+type Policy interface {
+	/*
+		AllowType reports whether properties of values of the given type can be
+		looked up.  For map types this allows access to all keys, and for func
+		types this allows the function to be called.  Only maps, structs, funcs
+		and types with methods are checked.  Types implementing
+		TalesValue, TalesLookup, TalesPath or TalesValueContext must be allowed
+		before they are asked for properties.
+	*/
+	AllowType(t reflect.Type) bool
+	// AllowProperty reports whether the named field or method of the type can be used.
+	AllowProperty(t reflect.Type, name string) bool
+	// AllowStructure reports whether tal:content and tal:replace can use structure.
+	AllowStructure() bool
+}
+
+/*
+RenderPolicy restricts the data a template can use to the data allowed by the
+Policy.
+
+Paths that use data the policy does not allow stop the render with a
+PolicyError, as do values of types that are not allowed being output, tested
+for truth or given to a built in property.  The elements of slices, arrays
+and maps are checked in the same way.  The built in variables, such as repeat and macros, and the built
+in properties, such as length, are always allowed.
+*/
+func RenderPolicy(policy Policy) RenderConfig {
+	return func(t *Template, rc *renderContext) {
+		rc.talesContext.policy = policy
+	}
+}
+
+/*
+PolicyError is returned by Render if a template uses data or features not
+allowed by the Policy given to RenderPolicy.
+*/
+type PolicyError struct {
+	// Type is the type of the value, or nil if structure was not allowed.
+	Type reflect.Type
+	// Property is the field or method name, or empty if the type was not allowed.
+	Property string
+	// Expression is the TALES expression being evaluated.
+	Expression string
+}
+
+// Error returns a text description of the policy error.
+func (err *PolicyError) Error() string {
+	var msg string
+	switch {
+	case err.Type == nil:
+		msg = "structure is not allowed"
+	case err.Property == "":
+		msg = fmt.Sprintf("type %v is not allowed", err.Type)
+	default:
+		msg = fmt.Sprintf("property %v of type %v is not allowed", err.Property, err.Type)
+	}
+	return fmt.Sprintf("Tal policy error: %v in expression %q", msg, err.Expression)
+}
+
+/*
+Sandbox is a Policy that allows only the types, fields and methods that have
+been explicitly allowed.  Structure is not allowed unless Structure is set.
+
+A Sandbox should be fully set up before it is used for rendering.
+*/
+type Sandbox struct {
+	// Structure allows tal:content and tal:replace to use structure.
+	Structure bool
+	// types holds the allowed types and their allowed fields and methods
+	types map[reflect.Type]map[string]bool
+}
+
+// NewSandbox returns a Sandbox that allows nothing.
+func NewSandbox() *Sandbox {
+	return &Sandbox{types: make(map[reflect.Type]map[string]bool)}
+}
+
+/*
+Allow allows the type of the sample value, and the named fields and methods
+of it.  Struct fields can also be allowed by giving them the struct tag
+`tal:"allow"`.
+
+	sandbox := tal.NewSandbox().
+		Allow(map[string]interface{}{}).
+		Allow(&Order{}, "Total", "Items")
+*/
+func (s *Sandbox) Allow(sample interface{}, names ...string) *Sandbox {
+	sampleType := policyType(reflect.TypeOf(sample))
+	properties, ok := s.types[sampleType]
+	if !ok {
+		properties = make(map[string]bool)
+		s.types[sampleType] = properties
+	}
+	for _, name := range names {
+		properties[name] = true
+	}
+	return s
+}
+
+// AllowType returns true if the type has been allowed.
+func (s *Sandbox) AllowType(t reflect.Type) bool {
+	_, ok := s.types[t]
+	return ok
+}
+
+// AllowProperty returns true if the field or method has been allowed, or is a field tagged `tal:"allow"`.
+func (s *Sandbox) AllowProperty(t reflect.Type, name string) bool {
+	if s.types[t][name] {
+		return true
+	}
+	if t.Kind() == reflect.Struct {
+		if field, ok := t.FieldByName(name); ok {
+			return field.Tag.Get("tal") == "allow"
+		}
+	}
+	return false
+}
+
+// AllowStructure returns the value of Structure.
+func (s *Sandbox) AllowStructure() bool {
+	return s.Structure
+}
+
+// policyType removes any pointers from a type.
+func policyType(t reflect.Type) reflect.Type {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+/*
+policyExempt returns true for the values provided by the tal package itself,
+which are always allowed.
+*/
+func policyExempt(value interface{}) bool {
+	switch value.(type) {
+	case *repeatVariable, *Template:
+		return true
+	}
+	return value == Default || value == notFound
+}
+
+/*
+policyChecked returns true if values of the type can have properties other
+than the built in properties, and so must be allowed by the policy.
+*/
+func policyChecked(valueType reflect.Type) bool {
+	switch valueType.Kind() {
+	case reflect.Map, reflect.Struct, reflect.Func:
+		return true
+	}
+	return valueType.NumMethod() > 0 || reflect.PtrTo(valueType).NumMethod() > 0
+}
+
+/*
+allowType checks the type of a value against the policy.  If it is not
+allowed, the error is recorded and false returned.
+*/
+func (t *tales) allowType(valueType reflect.Type) bool {
+	if t.policy == nil || valueType == nil {
+		return true
+	}
+	valueType = policyType(valueType)
+	if !policyChecked(valueType) || t.policy.AllowType(valueType) {
+		return true
+	}
+	t.policyDenied(&PolicyError{Type: valueType})
+	return false
+}
+
+/*
+allowValue checks the type of a value that is output, tested for truth or
+read by a built in property against the policy.  For slices, arrays and maps
+the types of their keys and elements are checked as well.  If it is not
+allowed, the error is recorded and false returned.
+*/
+func (t *tales) allowValue(value interface{}) bool {
+	if t.policy == nil || value == nil || policyExempt(value) {
+		return true
+	}
+	return t.allowContainedType(reflect.TypeOf(value), make(map[reflect.Type]bool))
+}
+
+// allowContainedType checks a type and the types it contains against the policy.
+func (t *tales) allowContainedType(valueType reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[valueType] {
+		return true
+	}
+	seen[valueType] = true
+	if !t.allowType(valueType) {
+		return false
+	}
+	switch valueType = policyType(valueType); valueType.Kind() {
+	case reflect.Map:
+		return t.allowContainedType(valueType.Key(), seen) && t.allowContainedType(valueType.Elem(), seen)
+	case reflect.Slice, reflect.Array:
+		return t.allowContainedType(valueType.Elem(), seen)
+	}
+	return true
+}
+
+/*
+allowProperty checks a field or method against the policy.  If it is not
+allowed, the error is recorded and false returned.
+*/
+func (t *tales) allowProperty(valueType reflect.Type, name string) bool {
+	if t.policy == nil {
+		return true
+	}
+	valueType = policyType(valueType)
+	if t.policy.AllowProperty(valueType, name) {
+		return true
+	}
+	t.policyDenied(&PolicyError{Type: valueType, Property: name})
+	return false
+}
+
+// policyDenied records the first PolicyError of the render.
+func (t *tales) policyDenied(err *PolicyError) {
+	t.debug("Policy denied access: %v\n", err)
+	if t.err == nil {
+		err.Expression = strings.TrimSpace(t.expression)
+		t.err = err
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type account struct {
+	Name    string `tal:"allow"`
+	Email   string
+	deleted bool
+}
+
+func (a *account) Greeting() string {
+	return "Hello " + a.Name
+}
+
+func (a *account) Delete() string {
+	a.deleted = true
+	return "deleted"
+}
+
+func policyTestData() (map[string]interface{}, *account) {
+	acc := &account{Name: "Alice", Email: "alice@example.com"}
+	vals := make(map[string]interface{})
+	vals["account"] = acc
+	vals["items"] = []string{"a", "b"}
+	vals["html"] = "<b>bold</b>"
+	return vals, acc
+}
+
+func policyTestSandbox() *Sandbox {
+	return NewSandbox().
+		Allow(map[string]interface{}{}).
+		Allow(&account{}, "Greeting")
+}
+
+func runPolicyErrorTest(t *testing.T, tmpl string, data interface{}, policy Policy) *PolicyError {
+	templ, err := CompileTemplate(strings.NewReader(tmpl))
+	if err != nil {
+		t.Fatalf("Error compiling template: %v", err)
+	}
+	err = templ.Render(data, &bytes.Buffer{}, RenderPolicy(policy))
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("Expected a PolicyError for %v, got %v", tmpl, err)
+	}
+	return policyErr
+}
+
+func TestSandboxAllowed(t *testing.T) {
+	vals, _ := policyTestData()
+
+	runTest(t, talTest{
+		vals,
+		`<p tal:content="account/Name"></p><p tal:content="account/Greeting"></p><b tal:repeat="item items" tal:content="repeat/item/number"></b><p tal:content="items/length"></p><p tal:content="html"></p>`,
+		`<p>Alice</p><p>Hello Alice</p><b>1</b><b>2</b><p>2</p><p>&lt;b&gt;bold&lt;/b&gt;</p>`,
+	}, RenderPolicy(policyTestSandbox()))
+}
+
+func TestSandboxDeniedMethod(t *testing.T) {
+	vals, acc := policyTestData()
+
+	policyErr := runPolicyErrorTest(t, `<p tal:content="account/Delete | string:fallback"></p>`, vals, policyTestSandbox())
+	if acc.deleted {
+		t.Errorf("Denied method was called")
+	}
+	if policyErr.Type != reflect.TypeOf(account{}) || policyErr.Property != "Delete" {
+		t.Errorf("Unexpected policy error %v", policyErr)
+	}
+	if policyErr.Expression != "account/Delete | string:fallback" {
+		t.Errorf("Expected the expression in the error, got %v", policyErr)
+	}
+	if policyErr.Error() != `Tal policy error: property Delete of type tal.account is not allowed in expression "account/Delete | string:fallback"` {
+		t.Errorf("Unexpected error message: %v", policyErr)
+	}
+}
+
+func TestSandboxDeniedFieldAndType(t *testing.T) {
+	vals, _ := policyTestData()
+	vals["settings"] = settings{"theme": "dark"}
+
+	policyErr := runPolicyErrorTest(t, `<p>${account/Email}</p>`, vals, policyTestSandbox())
+	if policyErr.Property != "Email" {
+		t.Errorf("Expected the Email field to be denied, got %v", policyErr)
+	}
+
+	policyErr = runPolicyErrorTest(t, `<p tal:content="settings/theme"></p>`, vals, policyTestSandbox())
+	if policyErr.Type != reflect.TypeOf(settings{}) || policyErr.Property != "" {
+		t.Errorf("Expected the settings type to be denied, got %v", policyErr)
+	}
+
+	// The root data must be allowed too.
+	runPolicyErrorTest(t, `<p tal:content="account/Name"></p>`, vals, NewSandbox())
+}
+
+func TestSandboxDeniedFunc(t *testing.T) {
+	vals, _ := policyTestData()
+	called := false
+	vals["reset"] = func() string {
+		called = true
+		return "reset"
+	}
+
+	runPolicyErrorTest(t, `<p tal:content="reset"></p>`, vals, policyTestSandbox())
+	if called {
+		t.Errorf("Denied function was called")
+	}
+	runTest(t, talTest{vals, `<p tal:content="reset"></p>`, `<p>reset</p>`}, RenderPolicy(policyTestSandbox().Allow(func() string { return "" })))
+}
+
+func TestSandboxStructure(t *testing.T) {
+	vals, _ := policyTestData()
+
+	policyErr := runPolicyErrorTest(t, `<div>Before<p tal:replace="structure html"></p></div>`, vals, policyTestSandbox())
+	if policyErr.Type != nil || policyErr.Error() != `Tal policy error: structure is not allowed in expression "html"` {
+		t.Errorf("Unexpected policy error %v", policyErr)
+	}
+
+	sandbox := policyTestSandbox()
+	sandbox.Structure = true
+	runTest(t, talTest{vals, `<div tal:content="structure html"></div>`, `<div><b>bold</b></div>`}, RenderPolicy(sandbox))
+}
+
+type policyProbe struct {
+	calls *int
+}
+
+func (p policyProbe) TalesBool() bool {
+	*p.calls++
+	return true
+}
+
+func (p policyProbe) String() string {
+	*p.calls++
+	return "probe"
+}
+
+func TestSandboxDeniedOutput(t *testing.T) {
+	calls := 0
+	probe := policyProbe{&calls}
+	vals := map[string]interface{}{
+		"probe":  probe,
+		"probes": []policyProbe{probe},
+		"byName": map[string]policyProbe{"a": probe},
+		"extra":  map[string]interface{}{"title": probe},
+	}
+	probeType := reflect.TypeOf(probe)
+	byNameType := reflect.TypeOf(vals["byName"])
+
+	for _, test := range []struct {
+		tmpl       string
+		deniedType reflect.Type
+	}{
+		{`<p tal:condition="probe">Shown</p>`, probeType},
+		{`<p tal:omit-tag="probe">Shown</p>`, probeType},
+		{`<p tal:condition="not:probe">Shown</p>`, probeType},
+		{`<p tal:content="probe"></p>`, probeType},
+		{`<p>${probe}</p>`, probeType},
+		{`<p tal:content="string:${probe}"></p>`, probeType},
+		{`<p tal:attributes="title probe"></p>`, probeType},
+		{`<input tal:attributes="checked probe">`, probeType},
+		{`<p tal:content="probes"></p>`, probeType},
+		{`<p tal:content="probes/first"></p>`, probeType},
+		{`<p tal:content="probes/last"></p>`, probeType},
+		{`<p tal:content="byName/keys"></p>`, byNameType},
+		{`<p tal:attributes="* byName"></p>`, byNameType},
+		{`<p tal:attributes="* extra"></p>`, probeType},
+	} {
+		policyErr := runPolicyErrorTest(t, test.tmpl, vals, policyTestSandbox())
+		if policyErr.Type != test.deniedType || policyErr.Property != "" {
+			t.Errorf("Expected type %v to be denied for %v, got %v", test.deniedType, test.tmpl, policyErr)
+		}
+	}
+	if calls != 0 {
+		t.Errorf("Methods of a denied type were called %v times", calls)
+	}
+
+	runTest(t, talTest{vals, `<p tal:condition="probe" tal:content="probes/first"></p>`, `<p>probe</p>`}, RenderPolicy(policyTestSandbox().Allow(probe)))
+}
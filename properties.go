@@ -0,0 +1,197 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+A PropertyFunc provides a built in property, such as length or upper, for
+values that do not have a field, key or method of that name.
+
+The returned bool is false if the property is not available for the value.
+*/
+type PropertyFunc func(value interface{}) (interface{}, bool)
+
+// builtinProperties holds the built in properties available in all paths.
+var builtinProperties = map[string]PropertyFunc{
+	"length":     propertyLength,
+	"empty":      propertyEmpty,
+	"upper":      stringProperty(strings.ToUpper),
+	"lower":      stringProperty(strings.ToLower),
+	"trim":       stringProperty(strings.TrimSpace),
+	"capitalize": stringProperty(capitalize),
+	"first":      propertyFirst,
+	"last":       propertyLast,
+	"keys":       propertyKeys,
+	"abs":        propertyAbs,
+}
+
+/*
+RenderProperty adds or replaces a built in property for the render.  A nil
+PropertyFunc removes the property.
+
+Built in properties are only used if the value does not have a field, key or
+method of the same name.
+*/
+func RenderProperty(name string, property PropertyFunc) RenderConfig {
+	return func(t *Template, rc *renderContext) {
+		if rc.talesContext.properties == nil {
+			rc.talesContext.properties = make(map[string]PropertyFunc, len(builtinProperties))
+			for k, v := range builtinProperties {
+				rc.talesContext.properties[k] = v
+			}
+		}
+		if property == nil {
+			delete(rc.talesContext.properties, name)
+			return
+		}
+		rc.talesContext.properties[name] = property
+	}
+}
+
+/*
+resolveBuiltinProperty returns the value of a built in property, or notFound
+if there is no such property for the value.
+*/
+func (t *tales) resolveBuiltinProperty(value interface{}, property string) interface{} {
+	properties := t.properties
+	if properties == nil {
+		properties = builtinProperties
+	}
+	propertyFunc, ok := properties[property]
+	if !ok || !t.allowValue(value) {
+		return notFound
+	}
+	result, ok := propertyFunc(value)
+	if !ok {
+		return notFound
+	}
+	t.debug("Found built in property %v\n", property)
+	return result
+}
+
+// propertyLength returns the length of strings (in characters), slices, arrays, maps and channels.
+func propertyLength(value interface{}) (interface{}, bool) {
+	data := reflect.ValueOf(value)
+	switch data.Kind() {
+	case reflect.String:
+		return utf8.RuneCountInString(data.String()), true
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Chan:
+		return data.Len(), true
+	}
+	return nil, false
+}
+
+// propertyEmpty returns true if a string, slice, array or map has no contents.
+func propertyEmpty(value interface{}) (interface{}, bool) {
+	data := reflect.ValueOf(value)
+	switch data.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return data.Len() == 0, true
+	}
+	return nil, false
+}
+
+// stringProperty returns a PropertyFunc that applies the given function to strings.
+func stringProperty(fn func(string) string) PropertyFunc {
+	return func(value interface{}) (interface{}, bool) {
+		data := reflect.ValueOf(value)
+		if data.Kind() != reflect.String {
+			return nil, false
+		}
+		return fn(data.String()), true
+	}
+}
+
+// capitalize makes the first character of a string upper case.
+func capitalize(value string) string {
+	first, size := utf8.DecodeRuneInString(value)
+	if size == 0 {
+		return value
+	}
+	return string(unicode.ToUpper(first)) + value[size:]
+}
+
+// propertyFirst returns the first item in a slice or array.
+func propertyFirst(value interface{}) (interface{}, bool) {
+	data := reflect.ValueOf(value)
+	switch data.Kind() {
+	case reflect.Slice, reflect.Array:
+		if data.Len() > 0 {
+			return data.Index(0).Interface(), true
+		}
+	}
+	return nil, false
+}
+
+// propertyLast returns the last item in a slice or array.
+func propertyLast(value interface{}) (interface{}, bool) {
+	data := reflect.ValueOf(value)
+	switch data.Kind() {
+	case reflect.Slice, reflect.Array:
+		if data.Len() > 0 {
+			return data.Index(data.Len() - 1).Interface(), true
+		}
+	}
+	return nil, false
+}
+
+// propertyKeys returns the keys of a map as a sorted slice.
+func propertyKeys(value interface{}) (interface{}, bool) {
+	data := reflect.ValueOf(value)
+	if data.Kind() != reflect.Map {
+		return nil, false
+	}
+	keys := data.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return lessValue(keys[i], keys[j])
+	})
+	result := make([]interface{}, len(keys))
+	for i, key := range keys {
+		result[i] = key.Interface()
+	}
+	return result, true
+}
+
+// lessValue orders numbers numerically and all other values by their text.
+func lessValue(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() < b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() < b.Float()
+	case reflect.String:
+		return a.String() < b.String()
+	}
+	return fmt.Sprint(a.Interface()) < fmt.Sprint(b.Interface())
+}
+
+// propertyAbs returns the absolute value of a number, keeping its type.
+func propertyAbs(value interface{}) (interface{}, bool) {
+	data := reflect.ValueOf(value)
+	switch data.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if data.Int() < 0 {
+			return reflect.ValueOf(-data.Int()).Convert(data.Type()).Interface(), true
+		}
+	case reflect.Float32, reflect.Float64:
+		if data.Float() < 0 {
+			return reflect.ValueOf(-data.Float()).Convert(data.Type()).Interface(), true
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+	default:
+		return nil, false
+	}
+	return value, true
+}
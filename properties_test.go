@@ -0,0 +1,79 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuiltinStringProperties(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["name"] = "  élise Smith "
+	vals["title"] = label("Hello World")
+
+	runTest(t, talTest{
+		vals,
+		`<p tal:content="name/trim"></p><p tal:content="name/trim/upper"></p><p tal:content="title/lower"></p><p tal:content="name/trim/capitalize"></p><p tal:content="name/length"></p><p tal:content="title/Upper"></p>`,
+		`<p>élise Smith</p><p>ÉLISE SMITH</p><p>hello world</p><p>Élise Smith</p><p>14</p><p>HELLO WORLD</p>`,
+	})
+}
+
+func TestBuiltinCollectionProperties(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["items"] = []string{"a", "b", "c"}
+	vals["none"] = []int{}
+	vals["counts"] = map[int]string{10: "ten", 2: "two", 1: "one"}
+
+	runTest(t, talTest{
+		vals,
+		`<p tal:content="items/length"></p><p tal:content="items/first"></p><p tal:content="items/last"></p><p tal:condition="none/empty">empty</p><p tal:content="none/first | string:no first"></p><b tal:repeat="key counts/keys" tal:content="key"></b><p tal:content="counts/length"></p>`,
+		`<p>3</p><p>a</p><p>c</p><p>empty</p><p>no first</p><b>1</b><b>2</b><b>10</b><p>3</p>`,
+	})
+}
+
+func TestBuiltinNumberProperties(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["balance"] = -42.5
+	vals["debt"] = cents(-1250)
+
+	runTest(t, talTest{
+		vals,
+		`<p tal:content="balance/abs"></p><p tal:content="debt/abs/Display"></p><p tal:content="balance/upper | string:not a string"></p>`,
+		`<p>42.5</p><p>$12.50</p><p>not a string</p>`,
+	})
+}
+
+func TestBuiltinPropertyPrecedence(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["stats"] = map[string]interface{}{"length": "long", "a": 1}
+
+	runTest(t, talTest{
+		vals,
+		`<p tal:content="stats/length"></p><p tal:content="stats/keys/length"></p>`,
+		`<p>long</p><p>2</p>`,
+	})
+}
+
+func TestRenderProperty(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["name"] = "alice"
+	vals["items"] = []int{1, 2}
+
+	slug := RenderProperty("slug", func(value interface{}) (interface{}, bool) {
+		s, ok := value.(string)
+		return strings.Replace(s, " ", "-", -1), ok
+	})
+	upper := RenderProperty("upper", func(value interface{}) (interface{}, bool) {
+		return "overridden", true
+	})
+	noLength := RenderProperty("length", nil)
+
+	runTest(t, talTest{
+		vals,
+		`<p tal:content="string:${name/upper} ${name/slug}"></p><p tal:content="items/length | string:no length"></p>`,
+		`<p>overridden alice</p><p>no length</p>`,
+	}, slug, upper, noLength)
+}
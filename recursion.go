@@ -0,0 +1,196 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"sort"
+	"strings"
+)
+
+// defaultMaxMacroRecursion is the number of times a macro can be nested within itself if RenderMaxMacroRecursion is not used.
+const defaultMaxMacroRecursion = 100
+
+// macroPathPrefix is the start of a literal path to a macro in the same template.
+const macroPathPrefix = "macros/"
+
+/*
+definingMacro records a metal:define-macro that is being compiled.
+*/
+type definingMacro struct {
+	// name is the name of the macro
+	name string
+	// guards is the value of compileState.macroGuards at the start of the macro
+	guards int
+}
+
+/*
+macroUse records an unconditional metal:use-macro of a macro in the same
+template.
+*/
+type macroUse struct {
+	// target is the name of the macro used
+	target string
+	// token is the start tag containing the metal:use-macro
+	token string
+}
+
+/*
+literalMacroName returns the name of the macro for use-macro expressions of
+the form macros/name, which always refer to a macro in the same template.
+*/
+func literalMacroName(expression string) (string, bool) {
+	expression = strings.TrimSpace(expression)
+	if strings.HasPrefix(expression, "path:") {
+		expression = strings.TrimSpace(expression[len("path:"):])
+	}
+	if !strings.HasPrefix(expression, macroPathPrefix) {
+		return "", false
+	}
+	name := expression[len(macroPathPrefix):]
+	if name == "" || strings.ContainsAny(name, "/?|$ ") {
+		return "", false
+	}
+	return name, true
+}
+
+/*
+guardMacroUses marks the content of the current element as conditional, so
+that any metal:use-macro within it is not treated as always being used.
+*/
+func (state *compileState) guardMacroUses() {
+	state.macroGuards++
+	state.appendAction(func() {
+		state.macroGuards--
+	})
+}
+
+/*
+recordMacroUse records a use of the given expression as a macro.  If the
+expression is literal and the use is not conditional, it is recorded against
+every macro currently being defined.
+*/
+func (state *compileState) recordMacroUse(expression string) {
+	target, ok := literalMacroName(expression)
+	if !ok {
+		return
+	}
+	for _, macro := range state.definingMacros {
+		if macro.guards != state.macroGuards {
+			continue
+		}
+		if state.macroUses == nil {
+			state.macroUses = make(map[string][]macroUse)
+		}
+		state.macroUses[macro.name] = append(state.macroUses[macro.name], macroUse{target: target, token: string(state.tokenizer.Raw())})
+	}
+}
+
+/*
+checkMacroCycles returns a CompileError of type ErrMacroRecursion if a macro
+always uses itself, either directly or through other macros.
+*/
+func (state *compileState) checkMacroCycles() *CompileError {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	status := make(map[string]int)
+	var chain []string
+	var visit func(name string) *CompileError
+	visit = func(name string) *CompileError {
+		status[name] = visiting
+		chain = append(chain, name)
+		for _, use := range state.macroUses[name] {
+			if _, ok := state.template.macros[use.target]; !ok {
+				continue
+			}
+			switch status[use.target] {
+			case visiting:
+				// Found a cycle - report it starting from the macro that is used again.
+				start := 0
+				for chain[start] != use.target {
+					start++
+				}
+				cycle := append(append([]string(nil), chain[start:]...), use.target)
+				return &CompileError{LastToken: use.token, ErrorType: ErrMacroRecursion, Err: &MacroRecursionError{Chain: cycle}}
+			case unvisited:
+				if err := visit(use.target); err != nil {
+					return err
+				}
+			}
+		}
+		chain = chain[:len(chain)-1]
+		status[name] = visited
+		return nil
+	}
+
+	names := make([]string, 0, len(state.macroUses))
+	for name := range state.macroUses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if status[name] == unvisited {
+			if err := visit(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+RenderMaxMacroRecursion sets how many times a macro, or the filling of a
+slot, can be used within itself.  A render that exceeds the limit stops with a MacroRecursionError.
+
+The default limit is 100.
+*/
+func RenderMaxMacroRecursion(depth int) RenderConfig {
+	return func(t *Template, rc *renderContext) {
+		rc.talesContext.limits.maxRecursion = depth
+	}
+}
+
+/*
+enterMacro adds a macro to the chain of macros being rendered, returning a
+MacroRecursionError if the macro is already in the chain too many times.
+*/
+func (l *renderLimits) enterMacro(macro *Template) error {
+	maxRecursion := l.maxRecursion
+	if maxRecursion <= 0 {
+		maxRecursion = defaultMaxMacroRecursion
+	}
+	uses, lastUse := 0, 0
+	for i, active := range l.macroChain {
+		if active == macro {
+			uses++
+			lastUse = i
+		}
+	}
+	if uses >= maxRecursion {
+		cycle := make([]string, 0, len(l.macroChain)-lastUse+1)
+		for _, active := range l.macroChain[lastUse:] {
+			cycle = append(cycle, active.macroName())
+		}
+		cycle = append(cycle, macro.macroName())
+		return &MacroRecursionError{Chain: cycle, Limit: maxRecursion}
+	}
+	l.macroChain = append(l.macroChain, macro)
+	return nil
+}
+
+// leaveMacro removes the last macro from the chain of macros being rendered.
+func (l *renderLimits) leaveMacro() {
+	l.macroChain = l.macroChain[:len(l.macroChain)-1]
+}
+
+// macroName returns the name of a macro for use in error messages.
+func (t *Template) macroName() string {
+	if t.name == "" {
+		return "(unnamed)"
+	}
+	return t.name
+}
@@ -0,0 +1,273 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+/*
+structureValue holds markup that is safe to output without escaping, such as
+the result of a sanitize: expression.
+*/
+type structureValue string
+
+/*
+SanitizePolicy lists the elements, attributes and URL schemes kept by
+sanitize: expressions.
+
+Elements that are not allowed are removed, but their content is kept.  The
+content of elements that can not be shown as text, such as <script> and
+<style>, is removed with them.  Comments are always removed.
+*/
+type SanitizePolicy struct {
+	// Elements maps the allowed element names to the attributes allowed on them.
+	Elements map[string][]string
+	// Attributes lists attributes allowed on all allowed elements.
+	Attributes []string
+	/*
+		URLSchemes lists the schemes allowed in URL attributes such as href and
+		src.  Relative URLs are always allowed.
+	*/
+	URLSchemes []string
+}
+
+/*
+sanitizeDropContent holds the elements whose content is removed along with
+them if they are not allowed.
+*/
+var sanitizeDropContent = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"iframe":   true,
+	"object":   true,
+	"embed":    true,
+	"template": true,
+	"noscript": true,
+	"noembed":  true,
+	"noframes": true,
+	"textarea": true,
+	"title":    true,
+	"xmp":      true,
+	"svg":      true,
+	"math":     true,
+}
+
+// sanitizeURLAttributes holds the attributes whose values are checked against the allowed URL schemes.
+var sanitizeURLAttributes = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"cite":       true,
+	"action":     true,
+	"formaction": true,
+	"poster":     true,
+	"background": true,
+	"longdesc":   true,
+	"data":       true,
+}
+
+/*
+DefaultSanitizePolicy returns the policy used by sanitize: expressions if
+RenderSanitizePolicy is not given.  It allows common text formatting, lists,
+tables, links and images, with http, https and mailto URLs.
+
+A new policy is returned each time, so it can be changed before use.
+*/
+func DefaultSanitizePolicy() *SanitizePolicy {
+	return &SanitizePolicy{
+		Elements: map[string][]string{
+			"a":          {"href"},
+			"abbr":       nil,
+			"b":          nil,
+			"blockquote": {"cite"},
+			"br":         nil,
+			"caption":    nil,
+			"code":       nil,
+			"dd":         nil,
+			"del":        nil,
+			"div":        nil,
+			"dl":         nil,
+			"dt":         nil,
+			"em":         nil,
+			"h1":         nil,
+			"h2":         nil,
+			"h3":         nil,
+			"h4":         nil,
+			"h5":         nil,
+			"h6":         nil,
+			"hr":         nil,
+			"i":          nil,
+			"img":        {"src", "alt", "width", "height"},
+			"ins":        nil,
+			"li":         nil,
+			"mark":       nil,
+			"ol":         {"start"},
+			"p":          nil,
+			"pre":        nil,
+			"q":          {"cite"},
+			"s":          nil,
+			"small":      nil,
+			"span":       nil,
+			"strong":     nil,
+			"sub":        nil,
+			"sup":        nil,
+			"table":      nil,
+			"tbody":      nil,
+			"td":         {"colspan", "rowspan"},
+			"tfoot":      nil,
+			"th":         {"colspan", "rowspan"},
+			"thead":      nil,
+			"tr":         nil,
+			"u":          nil,
+			"ul":         nil,
+		},
+		Attributes: []string{"title", "lang", "dir"},
+		URLSchemes: []string{"http", "https", "mailto"},
+	}
+}
+
+// defaultSanitizePolicy is used if RenderSanitizePolicy is not given.
+var defaultSanitizePolicy = DefaultSanitizePolicy()
+
+/*
+RenderSanitizePolicy sets the policy used by sanitize: expressions.
+*/
+func RenderSanitizePolicy(policy *SanitizePolicy) RenderConfig {
+	return func(t *Template, rc *renderContext) {
+		rc.talesContext.sanitizePolicy = policy
+	}
+}
+
+/*
+Sanitize parses markup as an HTML fragment and returns it with everything not
+allowed by the policy removed.
+*/
+func (p *SanitizePolicy) Sanitize(markup string) string {
+	context := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(markup), context)
+	if err != nil {
+		return ""
+	}
+	for _, node := range nodes {
+		context.AppendChild(node)
+	}
+	p.sanitizeChildren(context)
+
+	var out bytes.Buffer
+	for node := context.FirstChild; node != nil; node = node.NextSibling {
+		if err := html.Render(&out, node); err != nil {
+			return ""
+		}
+	}
+	return out.String()
+}
+
+/*
+sanitizeChildren removes the children of parent that are not allowed.  The
+content of elements that are not allowed is moved into parent and sanitized
+in turn.
+*/
+func (p *SanitizePolicy) sanitizeChildren(parent *html.Node) {
+	for node := parent.FirstChild; node != nil; {
+		next := node.NextSibling
+		switch node.Type {
+		case html.TextNode:
+		case html.ElementNode:
+			allowedAttributes, ok := p.Elements[node.Data]
+			if ok && node.Namespace == "" {
+				node.Attr = p.sanitizeAttributes(node.Attr, allowedAttributes)
+				p.sanitizeChildren(node)
+				break
+			}
+			if node.Namespace == "" && !sanitizeDropContent[node.Data] {
+				// Keep the content, which is checked next.
+				if node.FirstChild != nil {
+					next = node.FirstChild
+				}
+				for child := node.FirstChild; child != nil; child = node.FirstChild {
+					node.RemoveChild(child)
+					parent.InsertBefore(child, node)
+				}
+			}
+			parent.RemoveChild(node)
+		default:
+			parent.RemoveChild(node)
+		}
+		node = next
+	}
+}
+
+// sanitizeAttributes returns the attributes that are allowed.
+func (p *SanitizePolicy) sanitizeAttributes(attributes []html.Attribute, allowed []string) []html.Attribute {
+	result := attributes[:0]
+	for _, att := range attributes {
+		if att.Namespace != "" || !(containsString(allowed, att.Key) || containsString(p.Attributes, att.Key)) {
+			continue
+		}
+		if sanitizeURLAttributes[att.Key] && !p.allowURL(att.Val) {
+			continue
+		}
+		result = append(result, att)
+	}
+	return result
+}
+
+/*
+allowURL returns true if the URL is relative or uses an allowed scheme.
+Whitespace and control characters are ignored, as they are by browsers.
+*/
+func (p *SanitizePolicy) allowURL(value string) bool {
+	value = strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, value)
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return false
+	}
+	if parsed.Scheme == "" {
+		return true
+	}
+	for _, scheme := range p.URLSchemes {
+		if strings.EqualFold(scheme, parsed.Scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsString returns true if value is in list.
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+evaluateSanitize implements TALES sanitize: expressions.  The expression is
+evaluated and the result is sanitized as HTML, so that it is output without
+escaping.
+*/
+func (t *tales) evaluateSanitize(expression string) interface{} {
+	value := t.evaluateExpression(expression)
+	if value == nil || value == Default {
+		return value
+	}
+	policy := t.sanitizePolicy
+	if policy == nil {
+		policy = defaultSanitizePolicy
+	}
+	return structureValue(policy.Sanitize(t.format(value)))
+}
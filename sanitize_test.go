@@ -0,0 +1,83 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"testing"
+)
+
+func TestSanitizeContent(t *testing.T) {
+	vals := map[string]interface{}{
+		"comment": `<p onclick="steal()">Hello <b>world</b><script>alert(1)</script><blink>!</blink><!-- hidden --></p>`,
+	}
+
+	runTest(t, talTest{
+		vals,
+		`<div tal:content="sanitize: comment"></div>`,
+		`<div><p>Hello <b>world</b>!</p></div>`,
+	})
+	runTest(t, talTest{
+		vals,
+		`<div tal:replace="sanitize:comment"></div>`,
+		`<p>Hello <b>world</b>!</p>`,
+	})
+	runTest(t, talTest{
+		vals,
+		`<div>${sanitize:comment}</div>`,
+		`<div><p>Hello <b>world</b>!</p></div>`,
+	})
+}
+
+func TestSanitizeText(t *testing.T) {
+	vals := map[string]interface{}{
+		"text":  `Fish & chips < 5`,
+		"empty": nil,
+	}
+
+	runTest(t, talTest{vals, `<p tal:content="sanitize:text"></p>`, `<p>Fish &amp; chips &lt; 5</p>`})
+	runTest(t, talTest{vals, `<p tal:content="sanitize:empty">Gone</p>`, `<p></p>`})
+	runTest(t, talTest{vals, `<p tal:content="sanitize:default">Kept</p>`, `<p>Kept</p>`})
+}
+
+func TestSanitizeURLs(t *testing.T) {
+	vals := map[string]interface{}{
+		"links": `<a href="https://example.com/" target="_blank">A</a><a href="java&#x09;script:alert(1)">B</a><a href=" JAVASCRIPT:alert(1)">C</a><a href="/relative?q=1" title="Rel">D</a><img src="data:image/png;base64,AAAA" alt="E">`,
+	}
+
+	runTest(t, talTest{
+		vals,
+		`<div tal:content="sanitize:links"></div>`,
+		`<div><a href="https://example.com/">A</a><a>B</a><a>C</a><a href="/relative?q=1" title="Rel">D</a><img alt="E"/></div>`,
+	})
+}
+
+func TestSanitizePolicy(t *testing.T) {
+	vals := map[string]interface{}{
+		"markup": `<h1>Title</h1><p class="note">Body <a href="ftp://example.com/file">file</a></p><svg><script>alert(1)</script><text>Drawing</text></svg>`,
+	}
+	policy := &SanitizePolicy{
+		Elements:   map[string][]string{"p": {"class"}, "a": {"href"}},
+		URLSchemes: []string{"ftp"},
+	}
+
+	runTest(t, talTest{
+		vals,
+		`<div tal:content="sanitize:markup"></div>`,
+		`<div>Title<p class="note">Body <a href="ftp://example.com/file">file</a></p></div>`,
+	}, RenderSanitizePolicy(policy))
+
+	runTest(t, talTest{
+		vals,
+		`<div tal:content="sanitize:markup"></div>`,
+		`<div><h1>Title</h1><p>Body <a>file</a></p></div>`,
+	})
+}
+
+func TestSanitizeSandbox(t *testing.T) {
+	vals, _ := policyTestData()
+
+	// Sanitized markup is allowed even when structure is not.
+	runTest(t, talTest{vals, `<div tal:content="sanitize:html"></div>`, `<div><b>bold</b></div>`}, RenderPolicy(policyTestSandbox()))
+}
@@ -0,0 +1,138 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+/*
+CompilePreserveSource outputs markup that is not changed by TAL commands
+exactly as written in the template.
+
+Normally tags are rebuilt from their parsed form, so attribute quoting, the
+case of names, minimised attributes and character references in the template
+are changed in the output.  With source preserved, tags without commands,
+end tags, text and the attributes of tags with commands that are not changed
+by the commands are output as written.  Source is not preserved by default.
+*/
+func CompilePreserveSource(enabled bool) CompileConfig {
+	return func(state *compileState) {
+		state.preserveSource = enabled
+	}
+}
+
+// isHTMLSpace returns true for the characters treated as whitespace within tags.
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\f' || c == '\r'
+}
+
+/*
+sourceAttributes splits the source of a start tag into its attributes.
+
+The returned map is keyed by the lower case attribute name and holds the
+attribute as written, including any whitespace before it.  Only the first
+attribute with each name is included, matching the tokenizer.
+*/
+func sourceAttributes(tag string) map[string]string {
+	attributes := make(map[string]string)
+	// Skip the < and tag name.
+	i := 1
+	for i < len(tag) && !isHTMLSpace(tag[i]) && tag[i] != '/' && tag[i] != '>' {
+		i++
+	}
+	for i < len(tag) {
+		for i < len(tag) && (isHTMLSpace(tag[i]) || tag[i] == '/') {
+			i++
+		}
+		if i >= len(tag) || tag[i] == '>' {
+			break
+		}
+		start := i
+		for start > 0 && isHTMLSpace(tag[start-1]) {
+			start--
+		}
+		nameStart := i
+		// The first character of a name can be =, so is always part of it.
+		i++
+		for i < len(tag) && !isHTMLSpace(tag[i]) && tag[i] != '/' && tag[i] != '>' && tag[i] != '=' {
+			i++
+		}
+		name := strings.ToLower(tag[nameStart:i])
+		end := i
+		for i < len(tag) && isHTMLSpace(tag[i]) {
+			i++
+		}
+		if i < len(tag) && tag[i] == '=' {
+			i++
+			for i < len(tag) && isHTMLSpace(tag[i]) {
+				i++
+			}
+			if i < len(tag) && (tag[i] == '"' || tag[i] == '\'') {
+				quote := tag[i]
+				i++
+				for i < len(tag) && tag[i] != quote {
+					i++
+				}
+				if i < len(tag) {
+					i++
+				}
+			} else {
+				for i < len(tag) && !isHTMLSpace(tag[i]) && tag[i] != '>' {
+					i++
+				}
+			}
+			end = i
+		} else {
+			i = end
+		}
+		if _, seen := attributes[name]; seen {
+			continue
+		}
+		source := tag[start:end]
+		if start == nameStart {
+			// The attribute followed a quoted value without any whitespace.
+			source = " " + source
+		}
+		attributes[name] = source
+	}
+	return attributes
+}
+
+/*
+getSourceEndTagAction is used in place of getPlainEndTagAction when source is
+preserved, and outputs the end tag as written.
+*/
+func getSourceEndTagAction(state *compileState) endActionFunc {
+	return func() {
+		var d buffer
+		d.append(state.endTagSource)
+		state.template.addRenderInstruction(d)
+	}
+}
+
+/*
+getSourceEndTagUpdateAction sets the end tag of an element with commands to
+be output as written.
+*/
+func getSourceEndTagUpdateAction(state *compileState, currentEndTag *renderEndTag) endActionFunc {
+	return func() {
+		currentEndTag.source = state.endTagSource
+	}
+}
+
+/*
+sourceAttribute returns the attribute as written in the template, if source
+is preserved and the attribute has not been changed.
+*/
+func (d *renderStartTag) sourceAttribute(att html.Attribute) (string, bool) {
+	source, ok := d.attributeSource[strings.ToLower(att.Key)]
+	if !ok || d.originalAttributes.Get(att.Key) != att.Val {
+		return "", false
+	}
+	return source, true
+}
@@ -0,0 +1,58 @@
+// Copyright 2015 Colin Stewart.  All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE.txt file.
+
+package tal
+
+import (
+	"reflect"
+	"testing"
+)
+
+var preserveSource = []CompileConfig{CompilePreserveSource(true)}
+
+func TestPreserveSourcePlain(t *testing.T) {
+	tmpl := "<!doctype html>\n<HTML lang=en>\n<Body Class='main'>\n  <INPUT type=checkbox disabled>\n  <p>Fish&nbsp;&amp;&#160;chips &copy; 2015</P >\n</Body>\n</HTML>"
+
+	runCompileConfigTest(t, talTest{nil, tmpl, tmpl}, preserveSource)
+	runTest(t, talTest{
+		nil,
+		tmpl,
+		"<!DOCTYPE html>\n<html lang=\"en\">\n<body class=\"main\">\n  <input type=\"checkbox\" disabled=\"\">\n  <p>Fish &amp; chips © 2015</p>\n</body>\n</html>",
+	})
+}
+
+func TestPreserveSourceCommands(t *testing.T) {
+	vals := map[string]interface{}{"name": "Fish & Chips", "enabled": true}
+
+	runCompileConfigTest(t, talTest{
+		vals,
+		`<DIV class='menu' data-Item=a&amp;b tal:content="name" disabled>Old</DIV >`,
+		`<div class='menu' data-Item=a&amp;b disabled>Fish &amp; Chips</DIV >`,
+	}, preserveSource)
+	runCompileConfigTest(t, talTest{
+		vals,
+		`<input type=checkbox checked tal:attributes="checked enabled;title name" onclick='go("&nbsp;")'>`,
+		`<input type=checkbox checked="checked" onclick='go("&nbsp;")' title="Fish &amp; Chips">`,
+	}, preserveSource)
+	runCompileConfigTest(t, talTest{
+		vals,
+		`<p tal:omit-tag="">&nbsp;${name}&nbsp;</p><a href='x' title="${name}"   target=_blank>Link</A>`,
+		`&nbsp;Fish &amp; Chips&nbsp;<a href='x' title="Fish &amp; Chips"   target=_blank>Link</A>`,
+	}, preserveSource)
+}
+
+func TestSourceAttributes(t *testing.T) {
+	attributes := sourceAttributes("<a HREF='x'title=\"y\"\n  disabled data-x = z =odd class=a class=b/>")
+	expected := map[string]string{
+		"href":     ` HREF='x'`,
+		"title":    ` title="y"`,
+		"disabled": "\n  disabled",
+		"data-x":   ` data-x = z`,
+		"=odd":     ` =odd`,
+		"class":    ` class=a`,
+	}
+	if !reflect.DeepEqual(attributes, expected) {
+		t.Errorf("Expected %q, got %q", expected, attributes)
+	}
+}
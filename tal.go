@@ -44,6 +44,8 @@ tag is seen.
 type tagInfo struct {
 	tag        []byte
 	popActions []endActionFunc
+	// foreign is the foreign content namespace of the element, or empty for HTML
+	foreign string
 }
 
 /*
@@ -75,6 +77,70 @@ type compileState struct {
 	nextId int
 	// currentMacro holds the last metal:use-macro command seen.
 	currentMacro *useMacro
+	// prefixes holds the attribute prefixes that map onto tal and metal commands.
+	prefixes []namespacePrefix
+	// noInterpolation is true if ${...} should be output as-is.
+	noInterpolation bool
+	// macroGuards counts the enclosing elements whose content may not be rendered.
+	macroGuards int
+	// definingMacros holds the metal:define-macro elements currently open.
+	definingMacros []definingMacro
+	// macroUses holds the unconditional uses of macros by each macro.
+	macroUses map[string][]macroUse
+	// preserveSource is true if markup not changed by commands is output as written.
+	preserveSource bool
+	// endTagSource holds the end tag being compiled as written, if preserveSource is true.
+	endTagSource []byte
+}
+
+/*
+A CompileConfig function is one that can be passed as an option to CompileTemplate.
+*/
+type CompileConfig func(state *compileState)
+
+const (
+	// TalNamespace is the XML namespace of TAL commands.
+	TalNamespace = "http://xml.zope.org/namespaces/tal"
+	// MetalNamespace is the XML namespace of METAL commands.
+	MetalNamespace = "http://xml.zope.org/namespaces/metal"
+)
+
+// namespaceCommands maps the TAL and METAL namespaces onto their command prefix.
+var namespaceCommands = map[string]string{
+	TalNamespace:   "tal:",
+	MetalNamespace: "metal:",
+}
+
+/*
+namespacePrefix records an attribute prefix that is used for commands in the
+tal or metal namespace.
+*/
+type namespacePrefix struct {
+	// prefix is the attribute name prefix, e.g. "data-tal-"
+	prefix string
+	// command is the prefix of the command it maps to, e.g. "tal:"
+	command string
+}
+
+// defaultNamespacePrefixes are the prefixes recognised in all templates.
+var defaultNamespacePrefixes = []namespacePrefix{{"tal:", "tal:"}, {"metal:", "metal:"}}
+
+/*
+CompileNamespacePrefix uses the given attribute prefix for commands in the TAL
+or METAL namespace.
+
+The namespace must be either TalNamespace or MetalNamespace.  For example, to
+use data-tal-content in place of tal:content pass
+CompileNamespacePrefix("data-tal-", TalNamespace) to CompileTemplate.  Prefixes
+are matched without regard to case.
+*/
+func CompileNamespacePrefix(prefix string, namespace string) CompileConfig {
+	return func(state *compileState) {
+		command, ok := namespaceCommands[namespace]
+		if ok && prefix != "" {
+			state.prefixes = append(state.prefixes, namespacePrefix{prefix: strings.ToLower(prefix), command: command})
+		}
+	}
 }
 
 /*
@@ -134,16 +200,19 @@ func (state *compileState) error(errorType CompileErrorKind) *CompileError {
 // talAttributes are a slice of html.Attribute with helper methods for sorting.
 type talAttributes []html.Attribute
 
+// commandProperties holds the priority and startActionFunc of a command.
+type commandProperties struct {
+	Priority    int
+	StartAction startActionFunc
+}
+
 /*
 talCommandProperties holds the command priorities and startActionFuncs.
 
 All tal and metal attribute commands are sorted by the Priority before being
 handled.  Each startActionFunc is executed in turn.
 */
-var talCommandProperties = map[string]struct {
-	Priority    int
-	StartAction startActionFunc
-}{
+var talCommandProperties = map[string]commandProperties{
 	"metal:define-macro": {0, metalDefineMacroStart},
 	"metal:use-macro":    {1, metalUseMacroStart},
 	"metal:define-slot":  {2, metalDefineSlotStart},
@@ -157,9 +226,22 @@ var talCommandProperties = map[string]struct {
 	"tal:omit-tag":       {10, talOmitTagStart},
 }
 
+/*
+lookupCommand returns the properties of a built in or registered command.
+
+The returned bool is false if the command is not known.
+*/
+func lookupCommand(command string) (commandProperties, bool) {
+	properties, ok := talCommandProperties[command]
+	if ok {
+		return properties, true
+	}
+	return registeredCommand(command)
+}
+
 // talCommandPriority returns the priority of a command
 func talCommandPriority(command string) int {
-	properties, ok := talCommandProperties[command]
+	properties, ok := lookupCommand(command)
 	if !ok {
 		return 100
 	}
@@ -227,6 +309,8 @@ func metalDefineSlotStart(originalAttributes []html.Attribute, talValue string,
 	state.template.addInstruction(ds)
 
 	state.appendAction(metalDefineSlotEndAction(state, ds))
+	// The default content of the slot may be replaced.
+	state.guardMacroUses()
 	return nil
 }
 
@@ -257,6 +341,7 @@ func metalFillSlotStart(originalAttributes []html.Attribute, talValue string, st
 	}
 	// Defer to the end of the slot definition to register it
 	state.appendAction(metalFillSlotEnd(talValue, state))
+	state.guardMacroUses()
 	return nil
 }
 
@@ -272,6 +357,7 @@ func metalFillSlotEnd(name string, state *compileState) endActionFunc {
 		slotTemplate := newTemplate()
 		slotTemplate.instructions = state.template.instructions[startPoint:]
 		slotTemplate.macros = state.template.macros
+		slotTemplate.name = "slot " + name
 		state.currentMacro.filledSlots[name] = slotTemplate
 	}
 }
@@ -286,8 +372,11 @@ func metalUseMacroStart(originalAttributes []html.Attribute, talValue string, st
 	// Create a useMacro template instruction
 	um := &useMacro{expression: talValue, originalAttributes: originalAttributes, filledSlots: make(map[string]*Template)}
 	state.template.addInstruction(um)
+	state.recordMacroUse(talValue)
 	// Add the end tag index when we know it.
 	state.appendAction(metalUseMacroEndAction(state, um))
+	// Only filled slots are rendered within the element.
+	state.guardMacroUses()
 	return nil
 }
 
@@ -321,6 +410,11 @@ All work is deferred to metalDefineMacroEndAction.
 func metalDefineMacroStart(originalAttributes []html.Attribute, talValue string, state *compileState) *CompileError {
 	// Do all the work at the end.
 	state.appendAction(metalDefineMacroEndAction(state.template, talValue, len(state.template.instructions)))
+	// Record the macro so that uses of macros within it can be checked for recursion.
+	state.definingMacros = append(state.definingMacros, definingMacro{name: talValue, guards: state.macroGuards})
+	state.appendAction(func() {
+		state.definingMacros = state.definingMacros[:len(state.definingMacros)-1]
+	})
 	return nil
 }
 
@@ -336,17 +430,26 @@ func metalDefineMacroEndAction(t *Template, name string, startInstructionIndex i
 		// Create a new template for the macro
 		// Contains all instructions from the start to the end last instruction created.
 		macroTemplate := newTemplate()
+		macroTemplate.name = name
 		macroTemplate.instructions = t.instructions[startInstructionIndex:]
 		macroTemplate.macros = t.macros
 		t.macros[name] = macroTemplate
 	}
 }
 
+// templateCommentPrefix starts comments that are removed when the template is compiled.
+const templateCommentPrefix = "<!--!"
+
+// attributeSpreadKey is used in place of an attribute name in tal:attributes
+// to apply all attributes from a map or slice.
+const attributeSpreadKey = "*"
+
 /*
 talAttributesStart is used for tal:attributes.
 
 All arguments are split and the resulting name / value pairs are appended to
-the startTag's attribute expression list.  No endAction is used.
+the startTag's attribute expression list.  A name of attributeSpreadKey is
+kept as-is and expanded when rendered.  No endAction is used.
 */
 func talAttributesStart(originalAttributes []html.Attribute, talValue string, state *compileState) *CompileError {
 	definitionList := splitTalArguments(talValue)
@@ -420,7 +523,8 @@ func getTalDefineEndAction(t *Template) endActionFunc {
 talReplaceStart is used for tal:replace.
 
 text / structure is determined and a values on the existing
-talStartTag are changed as required.  No endAction is used.
+talStartTag are changed as required.  The only endAction is used to track
+that the content may not be rendered.
 */
 func talReplaceStart(originalAttributes []html.Attribute, talValue string, state *compileState) *CompileError {
 	if len(talValue) == 0 {
@@ -437,7 +541,7 @@ func talReplaceStart(originalAttributes []html.Attribute, talValue string, state
 	} else {
 		state.talStartTag.contentExpression = talValue
 	}
-
+	state.guardMacroUses()
 	return nil
 }
 
@@ -445,7 +549,8 @@ func talReplaceStart(originalAttributes []html.Attribute, talValue string, state
 talContentStart is used for tal:content.
 
 text / structure is determined and a values on the existing
-talStartTag are changed as required.  No endAction is used.
+talStartTag are changed as required.  The only endAction is used to track
+that the content may not be rendered.
 */
 func talContentStart(originalAttributes []html.Attribute, talValue string, state *compileState) *CompileError {
 	if len(talValue) == 0 {
@@ -462,6 +567,7 @@ func talContentStart(originalAttributes []html.Attribute, talValue string, state
 	} else {
 		state.talStartTag.contentExpression = talValue
 	}
+	state.guardMacroUses()
 	return nil
 }
 
@@ -478,6 +584,7 @@ func talConditionStart(originalAttributes []html.Attribute, talValue string, sta
 	condition := renderCondition{condition: talValue, originalAttributes: originalAttributes}
 	state.template.addInstruction(&condition)
 	state.appendAction(getTalConditionEndAction(state.template, &condition))
+	state.guardMacroUses()
 	return nil
 }
 
@@ -511,6 +618,7 @@ func talRepeatStart(originalAttributes []html.Attribute, talValue string, state
 	state.nextId++
 	state.template.addInstruction(&repeat)
 	state.appendAction(getTalRepeatEndAction(state.template, &repeat, len(state.template.instructions)-1))
+	state.guardMacroUses()
 	return nil
 }
 
@@ -584,6 +692,155 @@ func getTalEndTagAction(currentStartTag *renderStartTag, currentEndTag *renderEn
 	}
 }
 
+/*
+CompileInterpolation enables or disables ${expression} interpolation in text
+and attribute values.  Interpolation is enabled by default.
+*/
+func CompileInterpolation(enabled bool) CompileConfig {
+	return func(state *compileState) {
+		state.noInterpolation = !enabled
+	}
+}
+
+/*
+interpolationPart is a piece of text or attribute value that is either
+literal text or a TALES expression to be evaluated.
+*/
+type interpolationPart struct {
+	// literal holds text to be output as-is
+	literal string
+	// expression holds the TALES expression to evaluate if isExpression is true
+	expression   string
+	isExpression bool
+	// format holds the optional format specifier for the expression value
+	format string
+}
+
+/*
+parseInterpolation splits the value into literal text and ${expression} parts.
+
+$${ is used to output a literal ${.  The returned bool is false if the value
+does not need to be interpolated.  Interpolated values are always escaped, so
+a CompileError is returned if an expression uses the structure keyword.
+*/
+func (state *compileState) parseInterpolation(value string) ([]interpolationPart, bool, *CompileError) {
+	if state.noInterpolation || !strings.Contains(value, "${") {
+		return nil, false, nil
+	}
+	var parts []interpolationPart
+	var literal string
+	for {
+		start := strings.Index(value, "${")
+		if start == -1 {
+			break
+		}
+		if start > 0 && value[start-1] == '$' {
+			// Escaped - drop one of the dollars and carry on.
+			literal += value[:start-1] + "${"
+			value = value[start+2:]
+			continue
+		}
+		end := strings.Index(value[start:], "}")
+		if end == -1 {
+			// Not terminated - treat as literal text
+			break
+		}
+		literal += value[:start]
+		if literal != "" {
+			parts = append(parts, interpolationPart{literal: literal})
+			literal = ""
+		}
+		expression, format := splitFormat(value[start+2 : start+end])
+		if keyword := strings.Fields(expression); len(keyword) > 1 && keyword[0] == "structure" {
+			return nil, false, state.error(ErrInterpolationStructure)
+		}
+		parts = append(parts, interpolationPart{expression: expression, format: format, isExpression: true})
+		value = value[start+end+1:]
+	}
+	literal += value
+	if literal != "" {
+		parts = append(parts, interpolationPart{literal: literal})
+	}
+	return parts, true, nil
+}
+
+/*
+inRawTextElement returns true if the current element is a raw text element
+such as <script>.
+*/
+func (state *compileState) inRawTextElement() bool {
+	if len(state.tagStack) == 0 {
+		return false
+	}
+	top := state.tagStack[len(state.tagStack)-1]
+	return top.foreign == "" && htmlRawTextElements[string(top.tag)]
+}
+
+/*
+inRCDataElement returns true if the current element is an RCDATA element
+(such as <textarea>), whose content is text rather than HTML.
+*/
+func (state *compileState) inRCDataElement() bool {
+	if len(state.tagStack) == 0 {
+		return false
+	}
+	top := state.tagStack[len(state.tagStack)-1]
+	return top.foreign == "" && htmlRCDataElements[string(top.tag)]
+}
+
+/*
+namespaceElement returns the command prefix for elements in the tal or metal
+namespace (such as <tal:block>), or an empty string for all other elements.
+*/
+func (state *compileState) namespaceElement(tagName []byte) string {
+	command, ok := state.commandName(string(tagName))
+	if !ok {
+		return ""
+	}
+	return command[:strings.Index(command, ":")+1]
+}
+
+/*
+commandName maps an attribute name onto the tal: or metal: command it
+represents using the namespace prefixes in scope.
+
+The returned bool is false if the name is not in the tal or metal namespaces.
+*/
+func (state *compileState) commandName(name string) (string, bool) {
+	// Search from the most recently declared prefix so that inner declarations win.
+	for i := len(state.prefixes) - 1; i >= 0; i-- {
+		prefix := state.prefixes[i]
+		if strings.HasPrefix(name, prefix.prefix) && len(name) > len(prefix.prefix) {
+			return prefix.command + name[len(prefix.prefix):], true
+		}
+	}
+	return "", false
+}
+
+/*
+declareNamespaces looks for xmlns declarations of the TAL and METAL namespaces.
+
+Each prefix declared is added to the prefixes in scope, with an end action
+registered to remove them at the end of the current element.
+*/
+func (state *compileState) declareNamespaces(atts []html.Attribute) {
+	previousLength := len(state.prefixes)
+	for _, att := range atts {
+		if !strings.HasPrefix(att.Key, "xmlns:") || len(att.Key) == 6 {
+			continue
+		}
+		command, ok := namespaceCommands[att.Val]
+		if ok {
+			state.prefixes = append(state.prefixes, namespacePrefix{prefix: att.Key[6:] + ":", command: command})
+		}
+	}
+	if len(state.prefixes) > previousLength {
+		state.appendAction(func() {
+			state.prefixes = state.prefixes[:previousLength]
+		})
+	}
+}
+
 /*
 CompileTemplate reads the template in and compiles it ready for execution.
 
@@ -593,36 +850,90 @@ will be a CompileError object.
 The io.Reader must provide a stream of UTF-8 encoded text.  Templates
 render into UTF-8, so any conversion to or from other character sets must be
 carried out in the io.Reader and io.Writer used.
+
+CompileConfig options can be provided to change how the template is compiled.
 */
-func CompileTemplate(in io.Reader) (template *Template, err error) {
+func CompileTemplate(in io.Reader, config ...CompileConfig) (template *Template, err error) {
 	tokenizer := html.NewTokenizer(in)
 	template = newTemplate()
 	state := &compileState{template: template, tokenizer: tokenizer}
+	state.prefixes = append(state.prefixes, defaultNamespacePrefixes...)
+	for _, c := range config {
+		c(state)
+	}
 
 	for {
 		token := tokenizer.Next()
 		switch token {
 		case html.ErrorToken:
 			if tokenizer.Err() == io.EOF {
+				if err := state.checkMacroCycles(); err != nil {
+					return nil, err
+				}
 				return template, nil
 			}
 			return nil, tokenizer.Err()
 		case html.TextToken:
-			var d buffer
+			// Text() unescapes the text in place, so Raw() must be copied first.
+			raw := string(tokenizer.Raw())
 			// Text() returns a []byte that may change, so we immediately make a copy
-			d.appendString(html.EscapeString(string(tokenizer.Text())))
+			text := string(tokenizer.Text())
+			if state.preserveSource {
+				// Interpolate the text as written, so that literal text is kept as it is.
+				text = raw
+			}
+			parts, ok, err := state.parseInterpolation(text)
+			if err != nil && !state.inRawTextElement() {
+				return nil, err
+			}
+			if ok && !state.inRawTextElement() {
+				for _, part := range parts {
+					if part.isExpression && state.preserveSource {
+						template.addInstruction(&renderInterpolation{expression: html.UnescapeString(part.expression), format: html.UnescapeString(part.format)})
+					} else if part.isExpression {
+						template.addInstruction(&renderInterpolation{expression: part.expression, format: part.format})
+					} else if state.preserveSource {
+						template.addRenderInstruction([]byte(part.literal))
+					} else {
+						template.addRenderInstruction([]byte(html.EscapeString(part.literal)))
+					}
+				}
+				break
+			}
+			var d buffer
+			if state.preserveSource || state.inRawTextElement() || state.inRCDataElement() {
+				// The content of raw text and RCDATA elements is copied as written.
+				d.appendString(raw)
+			} else {
+				d.appendString(html.EscapeString(text))
+			}
 			template.addRenderInstruction(d)
-		case html.StartTagToken:
+		case html.StartTagToken, html.SelfClosingTagToken:
+			selfClosing := token == html.SelfClosingTagToken
+			// TagName() and TagAttr() change the tag in place, so Raw() must be copied first.
+			var source string
+			if state.preserveSource {
+				source = string(tokenizer.Raw())
+			}
 			rawTagName, hasAttr := tokenizer.TagName()
 			// rawTagName is a slice of bytes that may change when next() is called on the tokenizer.
 			// To avoid subtle bugs we create a copy of the data that we know will be immutable
 			tagName := make([]byte, len(rawTagName))
 			copy(tagName, rawTagName)
+			// SVG and MathML elements are output with their names in canonical case.
+			foreign := state.foreignNamespace(string(tagName))
+			outputName := foreignTagName(foreign, tagName)
+			if foreign != "" && !selfClosing && (htmlRawTextElements[string(tagName)] || htmlRCDataElements[string(tagName)]) {
+				// Elements such as <style> contain markup in foreign content.
+				tokenizer.NextIsNotRawText()
+			}
 			// Note the tag
-			var voidElement bool = htmlVoidElements[string(tagName)]
+			var voidElement bool = foreign == "" && htmlVoidElements[string(tagName)]
 			state.addTag(tagName)
+			state.tagStack[len(state.tagStack)-1].foreign = foreign
 
 			var d buffer
+			var atts []html.Attribute
 			var originalAtts []html.Attribute
 			var talAtts []html.Attribute
 			var key, val, rawkey, rawval []byte
@@ -633,33 +944,78 @@ func CompileTemplate(in io.Reader) (template *Template, err error) {
 				copy(key, rawkey)
 				val = make([]byte, len(rawval))
 				copy(val, rawval)
-				att := html.Attribute{Key: string(key), Val: string(val)}
-				if strings.HasPrefix(att.Key, "tal:") || strings.HasPrefix(att.Key, "metal:") {
+				atts = append(atts, html.Attribute{Key: string(key), Val: string(val)})
+			}
+			// Any namespace declarations apply to this element, so must be handled first.
+			state.declareNamespaces(atts)
+			namespace := state.namespaceElement(tagName)
+			var interpolatedAtts []attributeInterpolation
+			for _, att := range atts {
+				if command, ok := state.commandName(att.Key); ok {
+					att.Key = command
+					talAtts = append(talAtts, att)
+				} else if _, ok := registeredCommand(att.Key); ok {
+					talAtts = append(talAtts, att)
+				} else if namespace != "" && !strings.Contains(att.Key, ":") {
+					// Unprefixed attributes on namespace elements are commands.
+					att.Key = namespace + att.Key
 					talAtts = append(talAtts, att)
 				} else {
+					att.Key = foreignAttributeName(foreign, att.Key)
 					originalAtts = append(originalAtts, att)
+					parts, ok, err := state.parseInterpolation(att.Val)
+					if err != nil {
+						return nil, err
+					}
+					if ok {
+						interpolatedAtts = append(interpolatedAtts, attributeInterpolation{name: att.Key, parts: parts})
+					}
 				}
 			}
-			if len(talAtts) == 0 {
-				d.appendString("<")
-				d.append(tagName)
-				for _, att := range originalAtts {
-					d.appendString(" ")
-					d.appendString(att.Key)
-					d.appendString(`="`)
-					d.appendString(html.EscapeString(att.Val))
-					d.appendString(`"`)
+			if namespace != "" {
+				// Namespace elements are never output, so replace any tal:omit-tag with one that is always true.
+				for i, att := range talAtts {
+					if att.Key == "tal:omit-tag" {
+						talAtts = append(talAtts[:i], talAtts[i+1:]...)
+						break
+					}
+				}
+				talAtts = append(talAtts, html.Attribute{Key: "tal:omit-tag", Val: ""})
+			}
+			if len(talAtts) == 0 && len(interpolatedAtts) == 0 {
+				// Self-closing foreign elements need no end tag, and neither do any self-closing tags as written.
+				selfClosed := selfClosing && (foreign != "" || state.preserveSource)
+				if state.preserveSource {
+					d.appendString(source)
+				} else {
+					d.appendString("<")
+					d.append(outputName)
+					for _, att := range originalAtts {
+						d.appendString(" ")
+						d.appendString(att.Key)
+						d.appendString(`="`)
+						d.appendString(html.EscapeString(att.Val))
+						d.appendString(`"`)
+					}
+					if selfClosed {
+						d.appendString("/>")
+					} else {
+						d.appendString(">")
+					}
 				}
-				d.appendString(">")
 				template.addRenderInstruction(d)
 
 				// Register an action to add the close tag in when we see it.
 				// This is done via an action so that we can use different logic for close tags that have tal commands
-				// tagName is captured by the closure
-				if !voidElement {
-					state.appendAction(getPlainEndTagAction(template, tagName))
-				} else {
-					// If we have a void element, pop it off the stack straight away
+				// outputName is captured by the closure
+				if !voidElement && !selfClosed && state.preserveSource {
+					state.appendAction(getSourceEndTagAction(state))
+				} else if !voidElement && !selfClosed {
+					state.appendAction(getPlainEndTagAction(template, outputName))
+				}
+				if voidElement || selfClosing {
+					// If we have a void or self-closing element, pop it off the stack straight away
+					state.endTagSource = nil
 					err = state.popTag(tagName)
 					if err != nil {
 						return nil, err
@@ -670,14 +1026,17 @@ func CompileTemplate(in io.Reader) (template *Template, err error) {
 			}
 
 			// Empty out the start and end tag state
-			state.talStartTag = &renderStartTag{tagName: tagName, originalAttributes: originalAtts, voidElement: voidElement}
-			state.talEndTag = &renderEndTag{tagName: tagName, checkOmitTagFlag: false}
+			state.talStartTag = &renderStartTag{tagName: outputName, originalAttributes: originalAtts, attributeInterpolations: interpolatedAtts, voidElement: voidElement, rawText: foreign == "" && htmlRawTextElements[string(tagName)]}
+			state.talEndTag = &renderEndTag{tagName: outputName, checkOmitTagFlag: false}
+			if state.preserveSource {
+				state.talStartTag.attributeSource = sourceAttributes(source)
+			}
 
 			// Sort the tal attributes into priority order
-			sort.Sort(talAttributes(talAtts))
+			sort.Stable(talAttributes(talAtts))
 			// Process each one.
 			for _, talCommand := range talAtts {
-				properties, ok := talCommandProperties[talCommand.Key]
+				properties, ok := lookupCommand(talCommand.Key)
 				if !ok {
 					// As we are returning here we know that tokenizer will not get a chance to change the results of Raw() or Buffered()
 					return nil, newCompileError(ErrUnknownTalCommand, state.tokenizer.Raw(), state.tokenizer.Buffered())
@@ -687,6 +1046,12 @@ func CompileTemplate(in io.Reader) (template *Template, err error) {
 					return nil, err
 				}
 			}
+			if foreign != "" {
+				// Attributes set by tal:attributes use the same case as the original attributes.
+				for i, att := range state.talStartTag.attributeExpression {
+					state.talStartTag.attributeExpression[i].Key = foreignAttributeName(foreign, att.Key)
+				}
+			}
 			// Output the start tag
 			currentStartTag := state.talStartTag
 			currentEndTag := state.talEndTag
@@ -700,11 +1065,16 @@ func CompileTemplate(in io.Reader) (template *Template, err error) {
 				currentStartTag, currentEndTag and tagName are defined inside the for loop and so are captured within the closure
 			*/
 			state.insertAction(getTalEndTagAction(currentStartTag, currentEndTag, template))
+			if state.preserveSource {
+				state.appendAction(getSourceEndTagUpdateAction(state, currentEndTag))
+			}
 
 			/*
-				If we have a void element, run through all end actions immediately.
+				If we have a void or self-closing element, run through all end actions immediately.
+				Self-closing elements are given an end tag, as commands may give them content.
 			*/
-			if currentStartTag.voidElement {
+			if currentStartTag.voidElement || selfClosing {
+				state.endTagSource = nil
 				err = state.popTag(tagName)
 				if err != nil {
 					return nil, err
@@ -712,6 +1082,9 @@ func CompileTemplate(in io.Reader) (template *Template, err error) {
 			}
 
 		case html.EndTagToken:
+			if state.preserveSource {
+				state.endTagSource = append([]byte(nil), tokenizer.Raw()...)
+			}
 			tagName, _ := tokenizer.TagName()
 			// WARNING: tagName is not immutable.
 			// For popTag this is not a problem, for other uses it may be.
@@ -722,18 +1095,24 @@ func CompileTemplate(in io.Reader) (template *Template, err error) {
 				return nil, err
 			}
 			//template.addRenderInstruction(d)
-		case html.SelfClosingTagToken:
 		case html.CommentToken:
+			// Comments are output as written, apart from template comments (<!--! ... -->) which are removed.
+			raw := tokenizer.Raw()
+			if bytes.HasPrefix(raw, []byte(templateCommentPrefix)) {
+				break
+			}
 			var d buffer
-			d.appendString("<!--")
-			d.appendString(html.EscapeString(string(tokenizer.Text())))
-			d.appendString("-->")
+			d.append(raw)
 			template.addRenderInstruction(d)
 		case html.DoctypeToken:
 			var d buffer
-			d.appendString("<!DOCTYPE ")
-			d.appendString(html.EscapeString(string(tokenizer.Text())))
-			d.appendString(">")
+			if state.preserveSource {
+				d.append(tokenizer.Raw())
+			} else {
+				d.appendString("<!DOCTYPE ")
+				d.appendString(html.EscapeString(string(tokenizer.Text())))
+				d.appendString(">")
+			}
 			template.addRenderInstruction(d)
 		}
 	}
@@ -6,6 +6,8 @@ package tal
 
 import (
 	"bytes"
+	"errors"
+	"golang.org/x/net/html"
 	"log"
 	"strings"
 	"testing"
@@ -461,6 +463,61 @@ func TestTalAttributesBoolean(t *testing.T) {
 	})
 }
 
+func TestTalAttributesSpreadMap(t *testing.T) {
+	runTest(t, talTest{
+		struct {
+			Aria map[string]string
+		}{map[string]string{"aria-label": "Close & exit", "role": "button", "hidden": ""}},
+		`<body><button class="close" role="link" hidden tal:attributes="* Aria">X</button></body>`,
+		`<body><button class="close" role="button" aria-label="Close &amp; exit">X</button></body>`,
+	})
+}
+
+func TestTalAttributesSpreadInterfaceMap(t *testing.T) {
+	runTest(t, talTest{
+		struct {
+			Data  map[string]interface{}
+			Title string
+		}{map[string]interface{}{"data-id": 42, "class": nil, "title": Default, "disabled": true}, "Override"},
+		`<body><input class="wide" title="Original" tal:attributes="* Data;title Title"></body>`,
+		`<body><input title="Override" data-id="42" disabled="disabled"></body>`,
+	})
+}
+
+func TestTalAttributesSpreadSlice(t *testing.T) {
+	runTest(t, talTest{
+		struct {
+			Atts []html.Attribute
+		}{[]html.Attribute{{Key: "href", Val: "/home"}, {Key: "rel", Val: "nofollow"}}},
+		`<body><a href="#" tal:attributes="* Atts">Home</a></body>`,
+		`<body><a href="/home" rel="nofollow">Home</a></body>`,
+	})
+}
+
+func TestTalAttributesSpreadInvalidNames(t *testing.T) {
+	runTest(t, talTest{
+		struct {
+			Atts  map[string]string
+			Slice []html.Attribute
+		}{
+			map[string]string{`x"><script>alert(1)</script><a b`: "1", "": "2", "a b": "3", "a\tb": "4", "a=b": "5", "a/b": "6", "a'b": "7", "a\x00b": "8", "data-ok": "9"},
+			[]html.Attribute{{Key: "onclick>", Val: "x"}, {Key: "title", Val: "ok"}},
+		},
+		`<body><p tal:attributes="* Atts;* Slice">X</p></body>`,
+		`<body><p data-ok="9" title="ok">X</p></body>`,
+	})
+}
+
+func TestTalAttributesSpreadNothing(t *testing.T) {
+	runTest(t, talTest{
+		struct {
+			Other string
+		}{"Value"},
+		`<body><a href="#" tal:attributes="* nothing;* default;* Other">Home</a></body>`,
+		`<body><a href="#">Home</a></body>`,
+	})
+}
+
 func TestTalNamespaceAtts(t *testing.T) {
 	runTest(t, talTest{
 		struct {
@@ -472,6 +529,194 @@ func TestTalNamespaceAtts(t *testing.T) {
 	})
 }
 
+func TestTalBlockElement(t *testing.T) {
+	runTest(t, talTest{
+		struct {
+			Items []string
+		}{[]string{"One", "Two"}},
+		`<body><tal:block repeat="item Items"><b tal:content="item"></b>,</tal:block></body>`,
+		`<body><b>One</b>,<b>Two</b>,</body>`,
+	})
+}
+
+func TestTalBlockElementPrefixedCommands(t *testing.T) {
+	runTest(t, talTest{
+		struct {
+			Show  bool
+			Title string
+		}{true, "Title"},
+		`<body><tal:block tal:condition="Show" tal:omit-tag="nothing" content="Title">Default</tal:block><tal:block condition="not:Show">Hidden</tal:block></body>`,
+		`<body>Title</body>`,
+	})
+}
+
+func TestTalBlockElementNoCommands(t *testing.T) {
+	runTest(t, talTest{
+		struct{}{},
+		`<body><tal:block>Plain <b>text</b></tal:block></body>`,
+		`<body>Plain <b>text</b></body>`,
+	})
+}
+
+func TestMetalBlockElement(t *testing.T) {
+	runTest(t, talTest{
+		struct{}{},
+		`<body><metal:block define-macro="footer"><p>Footer</p></metal:block><div metal:use-macro="macros/footer"></div></body>`,
+		`<body><p>Footer</p><p>Footer</p></body>`,
+	})
+}
+
+func TestTalBlockElementUnknownCommand(t *testing.T) {
+	runCompileErrorTest(t, errTest{`<html><tal:block class="one">Hi</tal:block></html>`, ErrUnknownTalCommand})
+}
+
+func TestTalNamespacePrefixData(t *testing.T) {
+	runCompileConfigTest(t, talTest{
+		struct {
+			Title string
+			Link  string
+		}{"Title", "/home"},
+		`<body><h1 data-tal-content="Title" data-other="kept">Default</h1><a data-tal-attributes="href Link" DATA-TAL-omit-tag="">Home</a></body>`,
+		`<body><h1 data-other="kept">Title</h1>Home</body>`,
+	}, []CompileConfig{CompileNamespacePrefix("data-tal-", TalNamespace)})
+}
+
+func TestTalNamespacePrefixMetal(t *testing.T) {
+	runCompileConfigTest(t, talTest{
+		struct{}{},
+		`<body><p x-metal:define-macro="m">Macro</p><div x-metal:use-macro="macros/m"></div></body>`,
+		`<body><p>Macro</p><p>Macro</p></body>`,
+	}, []CompileConfig{CompileNamespacePrefix("x-metal:", MetalNamespace), CompileNamespacePrefix("ignored:", "urn:unknown")})
+}
+
+func TestTalNamespaceDeclaration(t *testing.T) {
+	runTest(t, talTest{
+		struct {
+			Title string
+		}{"Title"},
+		`<body><div xmlns:t="http://xml.zope.org/namespaces/tal" t:content="Title"></div><t:block content="Title"></t:block><p t:content="Title">Out of scope</p></body>`,
+		`<body><div xmlns:t="http://xml.zope.org/namespaces/tal">Title</div><t:block content="Title"></t:block><p t:content="Title">Out of scope</p></body>`,
+	})
+}
+
+func TestTalNamespaceDeclarationScope(t *testing.T) {
+	runTest(t, talTest{
+		struct {
+			Title string
+		}{"Title"},
+		`<body xmlns:t="http://xml.zope.org/namespaces/tal"><t:block content="Title"></t:block><img t:attributes="alt Title"></body><p t:content="Title">Out of scope</p>`,
+		`<body xmlns:t="http://xml.zope.org/namespaces/tal">Title<img alt="Title"></body><p t:content="Title">Out of scope</p>`,
+	})
+}
+
+func TestInterpolationText(t *testing.T) {
+	runTest(t, talTest{
+		map[string]interface{}{"user": map[string]interface{}{"name": "Alice & Bob", "id": 7}},
+		`<body><p>Hello ${user/name}, you are number ${user/id}.${nothing}${user/missing | string:!}</p></body>`,
+		`<body><p>Hello Alice &amp; Bob, you are number 7.!</p></body>`,
+	})
+}
+
+func TestInterpolationAttributes(t *testing.T) {
+	runTest(t, talTest{
+		map[string]interface{}{"user": map[string]interface{}{"name": "Alice \"A\"", "id": 7}},
+		`<body><a href="/users/${user/id}" title="${user/name}" class="user">Profile</a><img src="/${user/id}.png" tal:attributes="alt user/name"></body>`,
+		`<body><a href="/users/7" title="Alice &#34;A&#34;" class="user">Profile</a><img src="/7.png" alt="Alice &#34;A&#34;"></body>`,
+	})
+}
+
+func TestInterpolationOverriddenByAttributes(t *testing.T) {
+	runTest(t, talTest{
+		map[string]interface{}{"id": 7},
+		`<body><a href="/users/${id}" tal:attributes="href string:/other">Profile</a></body>`,
+		`<body><a href="/other">Profile</a></body>`,
+	})
+}
+
+func TestInterpolationEscaped(t *testing.T) {
+	runTest(t, talTest{
+		map[string]interface{}{"id": 7},
+		`<body><p title="$${id}">Cost: $5, $${id} is ${id}, ${unterminated</p></body>`,
+		`<body><p title="${id}">Cost: $5, ${id} is 7, ${unterminated</p></body>`,
+	})
+}
+
+func TestInterpolationScript(t *testing.T) {
+	runTest(t, talTest{
+		map[string]interface{}{"id": 7},
+		"<body><script>var a = `${id}`;</script><p>${id}</p></body>",
+		"<body><script>var a = `${id}`;</script><p>7</p></body>",
+	})
+}
+
+func TestRawTextElements(t *testing.T) {
+	runTest(t, talTest{
+		nil,
+		`<head><script>if (a < b && c > d) { x = "&amp;"; }</script><style>p > b::after { content: "&"; }</style></head>`,
+		`<head><script>if (a < b && c > d) { x = "&amp;"; }</script><style>p > b::after { content: "&"; }</style></head>`,
+	})
+}
+
+func TestRCDataElements(t *testing.T) {
+	runTest(t, talTest{
+		map[string]interface{}{"name": "Fish & Chips"},
+		`<head><title>A &amp; B &lt;i&gt; &nbsp;</title></head><textarea><b>Not bold</b> &copy;</textarea><title>${name}</title>`,
+		`<head><title>A &amp; B &lt;i&gt; &nbsp;</title></head><textarea><b>Not bold</b> &copy;</textarea><title>Fish &amp; Chips</title>`,
+	})
+}
+
+func TestComments(t *testing.T) {
+	runTest(t, talTest{
+		nil,
+		`<head><!--[if lt IE 9]><script src="html5shiv.js"></script><![endif]--></head><!--#include virtual="/footer.html" --><ul><!-- ko foreach: items --><li>&amp;</li><!-- /ko --></ul>`,
+		`<head><!--[if lt IE 9]><script src="html5shiv.js"></script><![endif]--></head><!--#include virtual="/footer.html" --><ul><!-- ko foreach: items --><li>&amp;</li><!-- /ko --></ul>`,
+	})
+}
+
+func TestTemplateComments(t *testing.T) {
+	runTest(t, talTest{
+		map[string]interface{}{"name": "Alice"},
+		`<p><!--! Greeting for the ${name} user -->Hello ${name}<!--!--></p><!-- Kept -->`,
+		`<p>Hello Alice</p><!-- Kept -->`,
+	})
+}
+
+func TestRawTextContent(t *testing.T) {
+	vals := map[string]interface{}{
+		"code":  `if (a < b && c) { s = "</script><script>alert(1)"; t = "<!--"; }`,
+		"text":  `<b>a & b</b>`,
+		"style": `p > b { color: red }`,
+	}
+
+	runTest(t, talTest{
+		vals,
+		`<script tal:content="code"></script>`,
+		`<script>if (a < b && c) { s = "<\/script><script>alert(1)"; t = "<\!--"; }</script>`,
+	})
+	runTest(t, talTest{vals, `<style tal:content="style"></style>`, `<style>p > b { color: red }</style>`})
+	runTest(t, talTest{vals, `<script tal:content="structure code"></script>`, `<script>` + vals["code"].(string) + `</script>`})
+	runTest(t, talTest{vals, `<textarea tal:content="text"></textarea>`, `<textarea>&lt;b&gt;a &amp; b&lt;/b&gt;</textarea>`})
+}
+
+func TestInterpolationStructure(t *testing.T) {
+	runCompileErrorTest(t, errTest{`<p>${structure html}</p>`, ErrInterpolationStructure})
+	runCompileErrorTest(t, errTest{`<p title="${ structure  html }"></p>`, ErrInterpolationStructure})
+	// Structure can still be used with tal:content, and in raw text.
+	runTest(t, talTest{
+		map[string]interface{}{"html": "<b>bold</b>", "structure": "path"},
+		`<p tal:content="structure html"></p><script>var a = "${structure html}";</script><p>${structure}</p>`,
+		`<p><b>bold</b></p><script>var a = "${structure html}";</script><p>path</p>`,
+	})
+}
+
+func TestInterpolationDisabled(t *testing.T) {
+	runCompileConfigTest(t, talTest{
+		map[string]interface{}{"id": 7},
+		`<body><p title="${id}">${id} $${id}</p></body>`,
+		`<body><p title="${id}">${id} $${id}</p></body>`,
+	}, []CompileConfig{CompileInterpolation(false)})
+}
+
 func TestTalVoidElementCondition(t *testing.T) {
 	vals := make(map[string]interface{})
 	vals["output"] = true
@@ -621,6 +866,58 @@ func TestTemplateStringOutput(t *testing.T) {
 	templ.String()
 }
 
+var errDisconnected = errors.New("client disconnected")
+
+// failingWriter accepts a number of writes and then fails.
+type failingWriter struct {
+	bytes.Buffer
+	writesLeft int
+	writes     int
+}
+
+func (w *failingWriter) Write(data []byte) (int, error) {
+	w.writes++
+	if w.writesLeft == 0 {
+		return 0, errDisconnected
+	}
+	w.writesLeft--
+	return w.Buffer.Write(data)
+}
+
+func TestRenderWriteErrors(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["title"] = "Title"
+	vals["items"] = []string{"a", "b", "c"}
+	templ, err := CompileTemplate(strings.NewReader(`<html><h1 tal:content="title">Hmm</h1><p>${title}</p><ul><li tal:repeat="item items" tal:content="item"></li></ul></html>`))
+	if err != nil {
+		t.Fatalf("Error compiling template: %v", err)
+	}
+	// Find how many writes a full render takes.
+	full := &failingWriter{writesLeft: -1}
+	if err := templ.Render(vals, full); err != nil {
+		t.Fatalf("Error rendering template: %v", err)
+	}
+
+	// Fail on each write in turn.
+	for i := 0; i < full.writes; i++ {
+		out := &failingWriter{writesLeft: i}
+		err := templ.Render(vals, out)
+		if !errors.Is(err, errDisconnected) {
+			t.Errorf("Write %v: expected the writer error, got %v", i, err)
+		}
+		var writeErr *WriteError
+		if !errors.As(err, &writeErr) {
+			t.Errorf("Write %v: expected a WriteError, got %T", i, err)
+		}
+		if out.writes != i+1 {
+			t.Errorf("Write %v: expected rendering to stop after the failed write, but %v writes were made", i, out.writes)
+		}
+		if !strings.HasPrefix(full.String(), out.String()) {
+			t.Errorf("Write %v: expected partial output, got %v", i, out.String())
+		}
+	}
+}
+
 type errTest struct {
 	Template                 string
 	ExpectedCompileErrorCode CompileErrorKind
@@ -648,7 +945,11 @@ type talTest struct {
 }
 
 func runTest(t *testing.T, test talTest, cfg ...RenderConfig) {
-	temp, err := CompileTemplate(strings.NewReader(test.Template))
+	runCompileConfigTest(t, test, nil, cfg...)
+}
+
+func runCompileConfigTest(t *testing.T, test talTest, compileCfg []CompileConfig, cfg ...RenderConfig) {
+	temp, err := CompileTemplate(strings.NewReader(test.Template), compileCfg...)
 	if err != nil {
 		t.Errorf("Error compiling template: %v\n", err)
 		return
@@ -5,10 +5,15 @@
 package tal
 
 import (
+	"context"
+	"database/sql/driver"
 	"fmt"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 /*
@@ -25,10 +30,54 @@ type TalesValue interface {
 		instead be passed to TalesValue for handling.
 
 		If the property is not supported by this object, nil should be returned.
+		To distinguish between a nil property and one that does not exist,
+		implement TalesLookup instead.
 	*/
 	TalesValue(property string) (result interface{})
 }
 
+/*
+TalesValueContext is a variant of TalesValue that is also given the
+context.Context passed to RenderContext.
+
+If a value implements TalesValueContext it is used in preference to
+TalesLookup and TalesValue.
+*/
+type TalesValueContext interface {
+	// TalesValueContext handles all property lookups on the object.
+	TalesValueContext(ctx context.Context, property string) (result interface{})
+}
+
+/*
+TalesLookup is an alternative to TalesValue that can report that a property
+does not exist, allowing alternative paths (|) and built in properties to be
+used.
+
+If a value implements both TalesLookup and TalesValue, TalesLookup is used.
+*/
+type TalesLookup interface {
+	// TalesLookup returns the value of the property and whether it was found.
+	TalesLookup(property string) (result interface{}, found bool)
+}
+
+/*
+TalesPath can be implemented by objects that resolve several path segments
+at once, such as proxies for database records or configuration trees.
+
+TalesPath takes precedence over TalesLookup and TalesValue.
+*/
+type TalesPath interface {
+	/*
+		TalesPath is given all remaining segments of the path, after any path
+		variables have been expanded.
+
+		The number of segments used to find the result is returned as consumed,
+		and must be at least one.  Any segments not consumed are resolved against
+		the result in the usual way.  If found is false the path is not found.
+	*/
+	TalesPath(path []string) (result interface{}, consumed int, found bool)
+}
+
 /*
 repeatVariable implements the tal repeat variable.
 
@@ -160,6 +209,24 @@ type tales struct {
 	debug logFunc
 	// originalAttributes holds the attributes of the current element
 	originalAttributes attributesList
+	// formatter converts values into text for output
+	formatter Formatter
+	// locale holds the rules used by the fmt/ path helpers
+	locale *localeRules
+	// properties holds the built in properties if changed by RenderProperty
+	properties map[string]PropertyFunc
+	// ctx is passed to functions and methods that take a context.Context
+	ctx context.Context
+	// limits holds the render limits, shared by all subtemplates
+	limits renderLimits
+	// policy restricts the data that paths can access, if set
+	policy Policy
+	// expression holds the expression being evaluated, for error messages
+	expression string
+	// err holds an error found while evaluating, which stops the render
+	err error
+	// sanitizePolicy is used by sanitize: expressions, if set
+	sanitizePolicy *SanitizePolicy
 }
 
 /*
@@ -174,10 +241,23 @@ var Default interface{} = struct{ Name string }{"Default"}
 // notFound is returned internally during path resolution if a property can not be found.
 var notFound interface{} = struct{ Name string }{"Not found"}
 
+/*
+TalesBool can be implemented by types that need to control whether they are
+treated as true or false by tal:condition, tal:omit-tag, boolean attributes
+and not: expressions.
+*/
+type TalesBool interface {
+	// TalesBool returns the truth value of the object.
+	TalesBool() bool
+}
+
 /*
 trueOfFalse determines whether a TALES value is true or false.
 
-Empty strings, integers and floats of 0 value, empty slices and false booleans are all false.
+Values implementing TalesBool decide for themselves.  Values implementing
+driver.Valuer (such as sql.NullInt64) use the truth of their driver value.
+Nil, empty strings, numbers of 0 value, empty slices, arrays and maps, nil
+pointers, zero time.Time values and false booleans are all false.
 
 Any other value is true.
 */
@@ -185,36 +265,69 @@ func trueOrFalse(value interface{}) bool {
 	if value == nil || value == notFound {
 		return false
 	}
+	reflectValue := reflect.ValueOf(value)
+	if reflectValue.Kind() == reflect.Ptr && reflectValue.IsNil() {
+		return false
+	}
 	switch a := value.(type) {
+	case TalesBool:
+		return a.TalesBool()
 	case string:
-		if len(a) == 0 {
-			return false
-		}
-	case int:
-		if a == 0 {
-			return false
-		}
-	case float32:
-		if a == 0 {
-			return false
-		}
-	case float64:
-		if a == 0 {
-			return false
-		}
+		return len(a) > 0
 	case bool:
 		return a
-	}
-	// Check whether the value is a sequence
-	reflectValue := reflect.Indirect(reflect.ValueOf(value))
-	if reflectValue.Kind() == reflect.Slice {
-		if reflectValue.Len() == 0 {
+	case time.Time:
+		return !a.IsZero()
+	case driver.Valuer:
+		driverValue, err := a.Value()
+		if err != nil {
 			return false
 		}
+		if _, ok := driverValue.(driver.Valuer); ok {
+			// Avoid looping on values that return themselves.
+			return true
+		}
+		return trueOrFalse(driverValue)
+	}
+	reflectValue = reflect.Indirect(reflectValue)
+	switch reflectValue.Kind() {
+	case reflect.Bool:
+		return reflectValue.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflectValue.Int() != 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return reflectValue.Uint() != 0
+	case reflect.Float32, reflect.Float64:
+		return reflectValue.Float() != 0
+	case reflect.Complex64, reflect.Complex128:
+		return reflectValue.Complex() != 0
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return reflectValue.Len() > 0
+	case reflect.Chan, reflect.Func, reflect.Interface:
+		return !reflectValue.IsNil()
 	}
 	return true
 }
 
+/*
+isTrue applies trueOrFalse to values allowed by the policy.  Values that are
+not allowed are false.
+*/
+func (t *tales) isTrue(value interface{}) bool {
+	return t.allowValue(value) && trueOrFalse(value)
+}
+
+/*
+format converts a value into text using the Formatter if it is allowed by the
+policy.  Values that are not allowed are output as an empty string.
+*/
+func (t *tales) format(value interface{}) string {
+	if !t.allowValue(value) {
+		return ""
+	}
+	return t.formatter(value)
+}
+
 // isValueSequence returns true if the value can be used as a sequence, i.e is
 // a slice or an array and has a length greater than zero.
 func isValueSequence(value interface{}) bool {
@@ -237,6 +350,7 @@ evaluate takes a TALES expression and returns it's result.
 func (t *tales) evaluate(talesExpression string, originalAttributes attributesList) interface{} {
 	// Figure out what kind of expression we have
 	t.originalAttributes = originalAttributes
+	t.expression = talesExpression
 	result := t.evaluateExpression(talesExpression)
 	t.debug("TALES evaluated %v to value %v\n", talesExpression, result)
 	return result
@@ -257,6 +371,13 @@ func (t *tales) evaluateExpression(talesExpression string) interface{} {
 			value = nil
 		}
 		return value
+	} else if strings.HasPrefix(talesExpression, "nocall:") {
+		// nocall: applies to paths, returning any final function or method uncalled.
+		value := t.evaluatePathExpression(talesExpression[7:], false)
+		if value == notFound {
+			value = nil
+		}
+		return value
 	} else if strings.HasPrefix(talesExpression, "string:") {
 		return t.evaluteStringExpression(talesExpression[7:])
 	} else if strings.HasPrefix(talesExpression, "exists:") {
@@ -266,10 +387,14 @@ func (t *tales) evaluateExpression(talesExpression string) interface{} {
 			return false
 		}
 		return true
+	} else if strings.HasPrefix(talesExpression, "json:") {
+		return t.evaluateJSON(talesExpression[5:])
+	} else if strings.HasPrefix(talesExpression, "sanitize:") {
+		return t.evaluateSanitize(talesExpression[9:])
 	} else if strings.HasPrefix(talesExpression, "not:") {
 		// Not applies to expressions, not paths
 		value := t.evaluateExpression(talesExpression[4:])
-		return !trueOrFalse(value)
+		return !t.isTrue(value)
 	} else {
 		// No prefix - treat as a path expression.
 		value := t.evaluatePath(talesExpression)
@@ -283,68 +408,120 @@ func (t *tales) evaluateExpression(talesExpression string) interface{} {
 
 /*
 evaluteStringExpression implements TALES string: expressions.
+
+Variables are substituted using either $path or ${path}.  The ${path} form
+supports alternatives (${a | b}) and an optional format specifier (see
+splitFormat).  $$ is used to output a single $.
 */
 func (t *tales) evaluteStringExpression(expression string) string {
 	expression = strings.TrimSpace(expression)
-	chars := []rune(expression)
-	length := len(chars)
-	var output buffer = make(buffer, 0, len(chars)*2)
-	var position, handled int
-	var foundDollar, inBrackets bool
-	for position < length {
-		char := chars[position]
-		switch char {
-		case '$':
-			if foundDollar {
-				// We've found a second dollar - are they back to back?
-				if handled == position {
-					output.appendString("$")
-					foundDollar = false
-				} else {
-					// Treat as the end of a variable
-					value := t.evaluatePath(string(chars[handled:position]))
-					output.appendString(fmt.Sprint(value))
-					foundDollar = true
-				}
-				handled = position + 1
-			} else {
-				// First dollar - output any normal text so far
-				if handled < position-1 {
-					output.appendString(string(chars[handled:position]))
-				}
-				handled = position + 1
-				foundDollar = true
+	var output buffer = make(buffer, 0, len(expression)*2)
+	for len(expression) > 0 {
+		dollar := strings.IndexByte(expression, '$')
+		if dollar == -1 {
+			output.appendString(expression)
+			break
+		}
+		output.appendString(expression[:dollar])
+		expression = expression[dollar+1:]
+		switch {
+		case strings.HasPrefix(expression, "$"):
+			// Escaped dollar
+			output.appendString("$")
+			expression = expression[1:]
+		case strings.HasPrefix(expression, "{"):
+			end := strings.IndexByte(expression, '}')
+			if end == -1 {
+				// No closing bracket - output as-is
+				output.appendString("$")
+				output.appendString(expression)
+				expression = ""
+				break
 			}
-		case ' ':
-			if foundDollar {
-				// End of the variable name - look it up.
-				value := t.evaluatePath(string(chars[handled:position]))
-				output.appendString(fmt.Sprint(value))
-				handled = position
-				foundDollar = false
+			path, format := splitFormat(expression[1:end])
+			output.appendString(t.formatValue(t.evaluatePath(path), format))
+			expression = expression[end+1:]
+		default:
+			// A variable runs up to the next space or dollar
+			end := strings.IndexAny(expression, " $")
+			if end == -1 {
+				end = len(expression)
 			}
-		case '{':
-			inBrackets = true
-		case '}':
-			if inBrackets {
-				value := t.evaluatePath(string(chars[handled+1 : position]))
-				output.appendString(fmt.Sprint(value))
-				handled = position + 1
-				inBrackets = false
-				foundDollar = false
+			if end == 0 {
+				output.appendString("$")
+				break
 			}
+			t.debug("String tales path looking for %v\n", expression[:end])
+			output.appendString(t.format(t.evaluatePath(expression[:end])))
+			expression = expression[end:]
 		}
-		position++
 	}
-	// See if we have any end of string terminated variables
-	if foundDollar {
-		// Last variable - expand it.
-		t.debug("String tales path looking for %v at end of loop\n", string(chars[handled:]))
-		value := t.evaluatePath(string(chars[handled:]))
-		output.appendString(fmt.Sprint(value))
-	} else {
-		// Finish off any remaining output
-		output.appendString(string(chars[handled:]))
+	return string(output)
+}
+
+/*
+splitFormat separates an optional format specifier from the end of a ${...}
+expression.
+
+Two forms of format are supported:
+
+	${price:%.2f}               - formats using fmt.Sprintf
+	${created:date:2006-01-02}  - formats a time.Time using the given layout
+
+The returned format is empty if no format specifier is present.
+*/
+func splitFormat(expression string) (path string, format string) {
+	if index := strings.Index(expression, ":%"); index > -1 {
+		return expression[:index], expression[index+1:]
+	}
+	if index := strings.Index(expression, ":date:"); index > -1 {
+		return expression[:index], expression[index+1:]
+	}
+	return expression, ""
+}
+
+/*
+formatValue converts a value into a string using a format from splitFormat.
+
+If no format is given, or a date format is given for a value that is not a
+time.Time, the Formatter is used.
+*/
+func (t *tales) formatValue(value interface{}, format string) string {
+	if !t.allowValue(value) {
+		return ""
+	}
+	switch {
+	case strings.HasPrefix(format, "%"):
+		return fmt.Sprintf(format, value)
+	case strings.HasPrefix(format, "date:"):
+		switch a := value.(type) {
+		case time.Time:
+			return a.Format(format[5:])
+		case *time.Time:
+			if a != nil {
+				return a.Format(format[5:])
+			}
+		}
+	}
+	return t.formatter(value)
+}
+
+/*
+interpolate returns the value of text containing ${expression} parts.
+
+Expressions that evaluate to nil or Default are replaced with an empty string.
+*/
+func (t *tales) interpolate(parts []interpolationPart, originalAttributes attributesList) string {
+	var output buffer
+	for _, part := range parts {
+		if !part.isExpression {
+			output.appendString(part.literal)
+			continue
+		}
+		value := t.evaluate(part.expression, originalAttributes)
+		if value != nil && value != Default {
+			output.appendString(t.formatValue(value, part.format))
+		}
 	}
 	return string(output)
 }
@@ -389,7 +566,20 @@ func (t *tales) expandPathSegment(segment string) (result string) {
 	return ""
 }
 
+// evaluatePath evaluates a path, calling any function or method found at the end of the path.
 func (t *tales) evaluatePath(talesExpression string) interface{} {
+	return t.evaluatePathExpression(talesExpression, true)
+}
+
+/*
+evaluatePathExpression evaluates a path: or implied TALES path expression.
+
+If call is false then a function or method found at the end of the path is
+returned as a value rather than being called.
+
+The | operator is supported, triggering recursive calls to evaluateExpression.
+*/
+func (t *tales) evaluatePathExpression(talesExpression string, call bool) interface{} {
 	// Do we have alternative expressions to evaluate?
 	talesExpression = strings.TrimSpace(talesExpression)
 
@@ -402,7 +592,7 @@ func (t *tales) evaluatePath(talesExpression string) interface{} {
 		pathExpression = talesExpression[:endOfExpression]
 	}
 
-	pathResult := t.evaluateSinglePath(pathExpression)
+	pathResult := t.evaluateSinglePath(pathExpression, call)
 
 	if endOfExpression > -1 {
 		if pathResult == notFound || pathResult == nil {
@@ -414,11 +604,9 @@ func (t *tales) evaluatePath(talesExpression string) interface{} {
 }
 
 /*
-evaluatePath evaluates a path: or implied TALES path expression.
-
-The | operator is supported, triggering recursive calls to evaluateExpression.
+evaluateSinglePath evaluates a single path with no alternatives.
 */
-func (t *tales) evaluateSinglePath(pathExpression string) interface{} {
+func (t *tales) evaluateSinglePath(pathExpression string, call bool) interface{} {
 	pathExpression = strings.TrimSpace(pathExpression)
 
 	// We need to figure out the root object (local, global, user, repeat) before we can evaluate further
@@ -468,26 +656,30 @@ func (t *tales) evaluateSinglePath(pathExpression string) interface{} {
 			t.debug("Unable to find repeat variable %v - returning not found\n", pathElements[1])
 			return notFound
 		}
-		pathValue := t.resolvePathObject(value, pathElements[2:])
+		pathValue := t.resolvePathObject(value, pathElements[2:], call)
 		return pathValue
 	}
 
 	// Check local variables next
 	value, ok := t.localVariables.GetValue(objectName)
 	if ok {
-		pathValue := t.resolvePathObject(value, pathElements[1:])
+		pathValue := t.resolvePathObject(value, pathElements[1:], call)
 		return pathValue
 	}
 
 	// Check the global variables
 	value, ok = t.globalVariables.GetValue(objectName)
 	if ok {
-		pathValue := t.resolvePathObject(value, pathElements[1:])
+		pathValue := t.resolvePathObject(value, pathElements[1:], call)
 		return pathValue
 	}
 
 	// Try the user provided data
-	pathValue := t.resolvePathObject(t.data, pathElements)
+	pathValue := t.resolvePathObject(t.data, pathElements, call)
+	if pathValue == notFound && objectName == formatHelpersRoot && t.resolvePathObject(t.data, pathElements[:1], false) == notFound {
+		// Nothing else is called fmt, so use the locale formatting helpers.
+		return t.evaluateFormatHelper(pathElements, call)
+	}
 	return pathValue
 }
 
@@ -497,15 +689,76 @@ resolvePathObject takes an object and traverses the path to get it's property.
 The object will have been found in local, global or user data.  Properties
 will be traversed, including maps, structs, functions and methods to get to
 a final object.
+
+If call is false then a function or method found at the end of the path is
+returned uncalled.  If call is true and the value itself is a function taking
+no arguments (e.g. a variable defined using nocall:) then it is called.
 */
-func (t *tales) resolvePathObject(value interface{}, path []string) interface{} {
-	candidate := value
-	for _, property := range path {
-		propertyExpanded := t.expandPathSegment(property)
-		if propertyExpanded == "" {
+func (t *tales) resolvePathObject(value interface{}, path []string, call bool) interface{} {
+	if len(path) == 0 && call {
+		funcValue := reflect.ValueOf(value)
+		if funcValue.Kind() == reflect.Func && pathArguments(funcValue.Type()) == 0 {
+			if !t.allowType(funcValue.Type()) {
+				return notFound
+			}
+			t.debug("Variable holds a function - calling it.\n")
+			return t.callFunc(funcValue)
+		}
+	}
+	candidate := t.resolvePathProperties(value, path, call)
+	if call && candidate != nil {
+		// Functions requiring arguments that have not been provided by the path can not be called.
+		funcValue := reflect.ValueOf(candidate)
+		if funcValue.Kind() == reflect.Func && pathArguments(funcValue.Type()) > 0 {
 			return notFound
 		}
-		candidate = t.resolveObjectProperty(candidate, propertyExpanded)
+	}
+	return candidate
+}
+
+// resolvePathProperties resolves each property in the path in turn.
+func (t *tales) resolvePathProperties(value interface{}, path []string, call bool) interface{} {
+	candidate := value
+	for i := 0; i < len(path); {
+		if pathValue, ok := candidate.(TalesPath); ok {
+			if !t.allowType(reflect.TypeOf(candidate)) {
+				return notFound
+			}
+			// Let the object resolve as much of the remaining path as it can.
+			remaining := make([]string, len(path)-i)
+			for j, property := range path[i:] {
+				remaining[j] = t.expandPathSegment(property)
+				if remaining[j] == "" {
+					return notFound
+				}
+			}
+			t.debug("TalesPath found - looking for path %v\n", remaining)
+			result, consumed, found := pathValue.TalesPath(remaining)
+			if !found {
+				result, consumed = t.resolveBuiltinProperty(candidate, remaining[0]), 1
+			}
+			if consumed < 1 {
+				consumed = 1
+			}
+			if consumed > len(remaining) {
+				consumed = len(remaining)
+			}
+			i += consumed
+			candidate = result
+		} else {
+			propertyExpanded := t.expandPathSegment(path[i])
+			if propertyExpanded == "" {
+				return notFound
+			}
+			// Only the last property in the path may be left uncalled.
+			result := t.resolveObjectProperty(candidate, propertyExpanded, call || i < len(path)-1)
+			if result == notFound {
+				// Fall back to the built in properties such as length
+				result = t.resolveBuiltinProperty(candidate, propertyExpanded)
+			}
+			i++
+			candidate = result
+		}
 		if candidate == notFound {
 			// If the property can't be found - return it
 			return notFound
@@ -520,7 +773,8 @@ func (t *tales) resolvePathObject(value interface{}, path []string) interface{}
 
 // callMethod attempts to call the given named property as a method.
 // A single return value is supported.
-func (t *tales) callMethod(data reflect.Value, goFieldName string) (result interface{}) {
+// If call is false the method value is returned without being called.
+func (t *tales) callMethod(data reflect.Value, goFieldName string, call bool) (result interface{}) {
 	// If calling the method panics, recover
 	defer func() {
 		if recover() != nil {
@@ -531,9 +785,15 @@ func (t *tales) callMethod(data reflect.Value, goFieldName string) (result inter
 	method := data.MethodByName(goFieldName)
 	t.debug("Result of looking for method %v: %v\n", goFieldName, method)
 	if method.IsValid() {
+		if !t.allowProperty(data.Type(), goFieldName) {
+			return notFound
+		}
+		if !call || pathArguments(method.Type()) > 0 {
+			// Methods that take an argument are called by the next property in the path.
+			return method.Interface()
+		}
 		t.debug("Found method in struct, calling.\n")
-		var callArgs []reflect.Value = make([]reflect.Value, 0, 0)
-		results := method.Call(callArgs)
+		results := method.Call(t.contextArguments(method.Type()))
 		if len(results) > 0 {
 			return results[0].Interface()
 		}
@@ -542,9 +802,10 @@ func (t *tales) callMethod(data reflect.Value, goFieldName string) (result inter
 	return notFound
 }
 
-// callFunc attempts to call the function provided.
+// callFunc attempts to call the function provided with the given arguments.
+// A context.Context is added as the first argument if the function takes one.
 // A single return value is supported.
-func (t *tales) callFunc(data reflect.Value) (result interface{}) {
+func (t *tales) callFunc(data reflect.Value, callArgs ...reflect.Value) (result interface{}) {
 	// If calling the function panics, recover
 	defer func() {
 		if recover() != nil {
@@ -552,24 +813,120 @@ func (t *tales) callFunc(data reflect.Value) (result interface{}) {
 		}
 	}()
 
-	var callArgs []reflect.Value = make([]reflect.Value, 0, 0)
-	results := data.Call(callArgs)
+	results := data.Call(append(t.contextArguments(data.Type()), callArgs...))
 	if len(results) > 0 {
 		return results[0].Interface()
 	}
 	return nil
 }
 
+// contextType is the type of context.Context.
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// takesContext returns true if the first parameter of the function is a context.Context.
+func takesContext(funcType reflect.Type) bool {
+	return funcType.NumIn() > 0 && funcType.In(0) == contextType
+}
+
+// pathArguments returns the number of arguments a function takes, excluding any context.Context.
+func pathArguments(funcType reflect.Type) int {
+	if takesContext(funcType) {
+		return funcType.NumIn() - 1
+	}
+	return funcType.NumIn()
+}
+
+// contextArguments returns the context.Context argument if the function takes one.
+func (t *tales) contextArguments(funcType reflect.Type) []reflect.Value {
+	if takesContext(funcType) {
+		return []reflect.Value{reflect.ValueOf(t.ctx)}
+	}
+	return nil
+}
+
+/*
+convertArgument converts a path property into a function argument of the
+given type.  The returned bool is false if the conversion is not possible.
+*/
+func convertArgument(property string, argType reflect.Type) (reflect.Value, bool) {
+	arg := reflect.New(argType).Elem()
+	switch argType.Kind() {
+	case reflect.String:
+		arg.SetString(property)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(property, 10, argType.Bits())
+		if err != nil {
+			return arg, false
+		}
+		arg.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(property, 10, argType.Bits())
+		if err != nil {
+			return arg, false
+		}
+		arg.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(property, argType.Bits())
+		if err != nil {
+			return arg, false
+		}
+		arg.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(property)
+		if err != nil {
+			return arg, false
+		}
+		arg.SetBool(b)
+	case reflect.Interface:
+		if !reflect.TypeOf(property).Implements(argType) {
+			return arg, false
+		}
+		arg.Set(reflect.ValueOf(property))
+	default:
+		return arg, false
+	}
+	return arg, true
+}
+
 /*
 resolveObjectProperty takes a single value and returns a named property.
 
-For maps the property is treated as a key.  For structs the property has
-it's first letter made upper case (i.e. exported) and are looked for in
-fields and methods.
+The property is looked for in the following order:
 
-Any func or method found will be called and it's value will be returned.
+ 1. If the value implements TalesValueContext, TalesLookup or TalesValue,
+    the result of the first of these implemented.
+ 2. For structs, exported fields and then exported methods.
+ 3. For all other named types, exported methods.
+ 4. For maps, the property is treated as a key.
+ 5. For functions that take a single argument, the function is called with
+    the property as the argument.
+
+Struct fields and methods are only looked for if the property starts with an
+upper case letter (i.e. is exported).  Methods of other named types are also
+looked for with the first letter in upper case, after any map key.
+
+Any func or method found that takes no arguments will be called and it's value
+will be returned, unless call is false.  Funcs and methods that take arguments
+are returned uncalled.
 */
-func (t *tales) resolveObjectProperty(value interface{}, property string) interface{} {
+func (t *tales) resolveObjectProperty(value interface{}, property string, call bool) interface{} {
+	if !policyExempt(value) && !t.allowType(reflect.TypeOf(value)) {
+		return notFound
+	}
+	// See if this is a TalesValueContext
+	if contextVar, ok := value.(TalesValueContext); ok {
+		t.debug("TalesValueContext found - looking for property %v\n", property)
+		return contextVar.TalesValueContext(t.ctx, property)
+	}
+	// See if this is a TalesLookup
+	if lookupVar, ok := value.(TalesLookup); ok {
+		t.debug("TalesLookup found - looking for property %v\n", property)
+		result, found := lookupVar.TalesLookup(property)
+		if !found {
+			return notFound
+		}
+		return result
+	}
 	// See if this is a TalesValue
 	talesVar, ok := value.(TalesValue)
 	if ok {
@@ -580,35 +937,62 @@ func (t *tales) resolveObjectProperty(value interface{}, property string) interf
 	rawData := reflect.ValueOf(value)
 	data := reflect.Indirect(rawData)
 	kind := data.Kind()
-	propertyValue := reflect.ValueOf(property)
 	t.debug("Looking for property %v in data %v (kind %v)\n", property, value, kind)
+	// Go field and method names start with upper case to be exported
+	goFieldName := exportedName(property)
+	if kind != reflect.Struct && data.IsValid() && isExported(property) {
+		// Named types of any kind can have methods, which take precedence over map keys.
+		result := t.resolveMethod(rawData, data, property, call)
+		if result != notFound {
+			return result
+		}
+	}
 	switch kind {
+	case reflect.Func:
+		// Call the function with the property as the argument
+		funcType := data.Type()
+		if pathArguments(funcType) != 1 || funcType.IsVariadic() {
+			return notFound
+		}
+		arg, ok := convertArgument(property, funcType.In(funcType.NumIn()-1))
+		if !ok {
+			return notFound
+		}
+		t.debug("Calling function with argument %v\n", property)
+		return t.callFunc(data, arg)
 	case reflect.Map:
-		// Lookup the value
-		mapResult := data.MapIndex(propertyValue)
+		// Lookup the value, converting the property to the type of the keys
+		key, ok := convertArgument(property, data.Type().Key())
+		if !ok {
+			return notFound
+		}
+		mapResult := data.MapIndex(key)
 		if mapResult.IsValid() {
 			t.debug("TALES: Found value in map\n")
 			mapValue := mapResult.Interface()
 			// Look at the value
 			mapValueReflection := reflect.ValueOf(mapValue)
 
-			if mapValueReflection.Kind() == reflect.Func {
+			if mapValueReflection.Kind() == reflect.Func && call && pathArguments(mapValueReflection.Type()) == 0 {
+				if !t.allowType(mapValueReflection.Type()) {
+					return notFound
+				}
 				t.debug("Found function - calling it.\n")
 				return t.callFunc(mapValueReflection)
 			}
 			return mapValue
 		}
-		return notFound
 	case reflect.Struct:
-		// Lookup the value
-		// Go field names start with upper case to be exported
-		goFieldName := strings.ToUpper(property[:1]) + property[1:]
 		// We only support looking for exported fields and methods on structs.
 		if property != goFieldName {
 			return notFound
 		}
+		// Lookup the value
 		structField := data.FieldByName(goFieldName)
 		if structField.IsValid() {
+			if !t.allowProperty(data.Type(), goFieldName) {
+				return notFound
+			}
 			// Make it concrete if it's an interface
 			// if structField.Kind() == reflect.Interface {
 			// 	structField = reflect.ValueOf(structField)
@@ -619,31 +1003,51 @@ func (t *tales) resolveObjectProperty(value interface{}, property string) interf
 			// Now get the reflected value of this interface
 			structField = reflect.ValueOf(structFieldInterface)
 			t.debug("New field kind: %v\n", structField.Kind())
-			if structField.Kind() == reflect.Func {
+			if structField.Kind() == reflect.Func && call && pathArguments(structField.Type()) == 0 {
+				if !t.allowType(structField.Type()) {
+					return notFound
+				}
 				t.debug("Found function - calling it.\n")
 				return t.callFunc(structField)
 			}
 			return structFieldInterface
-		} else {
-			// Start by looking for pointer methods.
-			if rawData != data {
-				result := t.callMethod(rawData, goFieldName)
-				if result != notFound {
-					return result
-				}
-			}
-			// Now call value methods
-			result := t.callMethod(data, goFieldName)
-			if result != notFound {
-				return result
-			}
 		}
-		// Not a struct field or method - return not found
-		return notFound
+		// Not a struct field - look for a method
+		return t.resolveMethod(rawData, data, goFieldName, call)
+	}
+	if data.IsValid() && !isExported(property) && goFieldName != property {
+		// Methods of named types other than structs can also be found using a lower case first letter.
+		return t.resolveMethod(rawData, data, goFieldName, call)
 	}
-	// Not a map or struct - return notFound
 	return notFound
+}
+
+/*
+resolveMethod looks for a method with the given name, first on the pointer
+(if the value is a pointer) and then on the value itself.
+*/
+func (t *tales) resolveMethod(rawData reflect.Value, data reflect.Value, goFieldName string, call bool) interface{} {
+	// Start by looking for pointer methods.
+	if rawData != data {
+		result := t.callMethod(rawData, goFieldName, call)
+		if result != notFound {
+			return result
+		}
+	}
+	// Now call value methods
+	return t.callMethod(data, goFieldName, call)
+}
+
+// exportedName returns the property with its first letter in upper case, as used by exported Go names.
+func exportedName(property string) string {
+	first, size := utf8.DecodeRuneInString(property)
+	return string(unicode.ToUpper(first)) + property[size:]
+}
 
+// isExported returns true if the property starts with an upper case letter.
+func isExported(property string) bool {
+	first, _ := utf8.DecodeRuneInString(property)
+	return unicode.IsUpper(first)
 }
 
 // newTalesContext sets up a new tales object with the given user data.
@@ -654,6 +1058,8 @@ func newTalesContext(data interface{}) *tales {
 		globalVariables: newContainer(),
 		repeatVariables: newContainer(),
 		debug:           defaultLogger,
+		formatter:       FormatValue,
+		ctx:             context.Background(),
 	}
 
 	return t
@@ -6,8 +6,13 @@ package tal
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestTalesDeepPaths(t *testing.T) {
@@ -602,6 +607,53 @@ func TestTalesStringMixed(t *testing.T) {
 	})
 }
 
+func TestTalesStringFormat(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["price"] = 12.5
+	vals["count"] = 7
+	vals["created"] = time.Date(2015, 12, 15, 10, 30, 0, 0, time.UTC)
+
+	runTalesTest(t, talesTest{
+		vals,
+		`<html><body><p tal:content="string: Price ${price:%.2f} for ${count:%03d} items on ${created:date:2006-01-02 15:04}"></p></body></html>`,
+		`<html><body><p>Price 12.50 for 007 items on 2015-12-15 10:30</p></body></html>`,
+	})
+}
+
+func TestTalesStringAlternatives(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["user"] = map[string]interface{}{"name": "Alice", "nick": nil}
+
+	runTalesTest(t, talesTest{
+		vals,
+		`<html><body><p tal:content="string: Hi ${user/nick | user/name}, ${user/missing | string:friend} {not a path}"></p></body></html>`,
+		`<html><body><p>Hi Alice, friend {not a path}</p></body></html>`,
+	})
+}
+
+func TestTalesStringUnterminated(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["user"] = "Alice"
+
+	runTalesTest(t, talesTest{
+		vals,
+		`<html><body><p tal:content="string: $user costs $ 5 ${user"></p></body></html>`,
+		`<html><body><p>Alice costs $ 5 ${user</p></body></html>`,
+	})
+}
+
+func TestTalesInterpolationFormat(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["price"] = 12.5
+	vals["created"] = time.Date(2015, 12, 15, 10, 30, 0, 0, time.UTC)
+
+	runTalesTest(t, talesTest{
+		vals,
+		`<html><body><p title="${price:%.1f}">${price:%.2f} on ${created:date:Jan 2}</p></body></html>`,
+		`<html><body><p title="12.5">12.50 on Dec 15</p></body></html>`,
+	})
+}
+
 func TestTalesBadMethods(t *testing.T) {
 	vals := make(map[string]interface{})
 	otherTemplate, _ := CompileTemplate(strings.NewReader("<html><h1>Test</h1></html>"))
@@ -683,6 +735,361 @@ func TestTalesFloatsTruth(t *testing.T) {
 	})
 }
 
+type greeter struct {
+	Prefix string
+}
+
+func (g greeter) Greet(name string) string {
+	return g.Prefix + " " + name
+}
+
+func (g greeter) Salute() string {
+	return g.Prefix + "!"
+}
+
+func TestTalesNocallMethod(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["greeter"] = greeter{"Hello"}
+
+	runTalesTest(t, talesTest{
+		vals,
+		`<html><body><p tal:define="greet nocall:greeter/Greet;salute nocall:greeter/Salute"><b tal:content="greet/Alice"></b> <i tal:content="salute"></i> <i tal:content="greeter/Greet/Bob"></i> <i tal:content="greeter/Greet"></i></p></body></html>`,
+		`<html><body><p><b>Hello Alice</b> <i>Hello!</i> <i>Hello Bob</i> <i></i></p></body></html>`,
+	})
+}
+
+func TestTalesNocallFunc(t *testing.T) {
+	vals := make(map[string]interface{})
+	calls := 0
+	vals["counter"] = func() int {
+		calls++
+		return calls
+	}
+	vals["double"] = func(i int) int {
+		return i * 2
+	}
+
+	runTalesTest(t, talesTest{
+		vals,
+		`<html><body><p tal:define="count nocall:counter" tal:content="count"></p><p tal:content="count | string:undefined"></p><b tal:content="double/21"></b><b tal:content="double/notanumber | string:NaN"></b></body></html>`,
+		`<html><body><p>1</p><p>undefined</p><b>42</b><b>NaN</b></body></html>`,
+	})
+}
+
+func TestTalesNocallTemplate(t *testing.T) {
+	vals := make(map[string]interface{})
+	macroTemplate, _ := CompileTemplate(strings.NewReader(`<b metal:define-macro="bold">Bold</b>`))
+	vals["shared"] = macroTemplate
+
+	runTalesTest(t, talesTest{
+		vals,
+		`<html><body><p tal:define="t nocall:shared"><i metal:use-macro="t/bold"></i></p><p tal:condition="exists:nocall:shared">Exists</p></body></html>`,
+		`<html><body><p><b>Bold</b></p></body></html>`,
+	})
+}
+
+type money struct {
+	Cents int64
+}
+
+func (m money) TalesBool() bool {
+	return m.Cents != 0
+}
+
+type cents int64
+
+func TestTalesNumericTruth(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["int64"] = int64(0)
+	vals["uint"] = uint(0)
+	vals["uint8"] = uint8(3)
+	vals["named"] = cents(0)
+	vals["namedTrue"] = cents(5)
+	vals["complex"] = complex(0, 0)
+
+	runTalesTest(t, talesTest{
+		vals,
+		`<html><body><p tal:condition="int64">int64</p><p tal:condition="uint">uint</p><p tal:condition="uint8">uint8</p><p tal:condition="named">named</p><p tal:condition="namedTrue">namedTrue</p><p tal:condition="complex">complex</p></body></html>`,
+		`<html><body><p>uint8</p><p>namedTrue</p></body></html>`,
+	})
+}
+
+func TestTalesCollectionTruth(t *testing.T) {
+	var nilPointer *money
+	vals := make(map[string]interface{})
+	vals["emptyMap"] = map[string]int{}
+	vals["fullMap"] = map[string]int{"a": 1}
+	vals["emptyArray"] = [0]int{}
+	vals["nilPointer"] = nilPointer
+	vals["zeroTime"] = time.Time{}
+	vals["now"] = time.Now()
+
+	runTalesTest(t, talesTest{
+		vals,
+		`<html><body><p tal:condition="emptyMap">emptyMap</p><p tal:condition="fullMap">fullMap</p><p tal:condition="emptyArray">emptyArray</p><p tal:condition="nilPointer">nilPointer</p><p tal:condition="zeroTime">zeroTime</p><p tal:condition="now">now</p></body></html>`,
+		`<html><body><p>fullMap</p><p>now</p></body></html>`,
+	})
+}
+
+func TestTalesBoolInterface(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["free"] = money{0}
+	vals["paid"] = &money{250}
+	vals["nullInt"] = sql.NullInt64{Int64: 5, Valid: false}
+	vals["zeroInt"] = sql.NullInt64{Int64: 0, Valid: true}
+	vals["validString"] = sql.NullString{String: "a", Valid: true}
+
+	runTalesTest(t, talesTest{
+		vals,
+		`<html><body><p tal:condition="free">free</p><p tal:condition="paid">paid</p><p tal:condition="not:free">not free</p><b tal:omit-tag="paid">omitted</b><p tal:condition="nullInt">nullInt</p><p tal:condition="zeroInt">zeroInt</p><p tal:condition="validString">validString</p><input tal:attributes="checked free"></body></html>`,
+		`<html><body><p>paid</p><p>not free</p>omitted<p>validString</p><input></body></html>`,
+	})
+}
+
+func (c cents) Display() string {
+	return fmt.Sprintf("$%d.%02d", c/100, c%100)
+}
+
+type tags []string
+
+func (t tags) Joined() string {
+	return strings.Join(t, ", ")
+}
+
+type settings map[string]string
+
+func (s settings) Count() int {
+	return len(s)
+}
+
+func (s *settings) Summary() string {
+	return fmt.Sprintf("%d settings", len(*s))
+}
+
+type label string
+
+func (l label) Upper() string {
+	return strings.ToUpper(string(l))
+}
+
+func TestTalesNamedTypeMethods(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["price"] = cents(1250)
+	vals["tags"] = tags{"go", "tal"}
+	vals["label"] = label("new")
+
+	runTalesTest(t, talesTest{
+		vals,
+		`<html><body><p tal:content="price/Display"></p><p tal:content="tags/Joined"></p><p tal:content="label/Upper"></p><p tal:content="label/Missing | string:no method"></p></body></html>`,
+		`<html><body><p>$12.50</p><p>go, tal</p><p>NEW</p><p>no method</p></body></html>`,
+	})
+}
+
+func TestTalesMethodsBeforeMapKeys(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["settings"] = settings{"Count": "key", "theme": "dark"}
+	vals["ptrSettings"] = &settings{"Summary": "key"}
+
+	runTalesTest(t, talesTest{
+		vals,
+		`<html><body><p tal:content="settings/Count"></p><p tal:content="settings/theme"></p><p tal:content="ptrSettings/Summary"></p></body></html>`,
+		`<html><body><p>2</p><p>dark</p><p>1 settings</p></body></html>`,
+	})
+}
+
+func TestTalesLowerCaseMethods(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["tags"] = tags{"go", "tal"}
+	vals["settings"] = settings{"count": "key", "theme": "dark"}
+	vals["ptrSettings"] = &settings{"theme": "dark"}
+	vals["user"] = struct{ Name string }{"Alice"}
+
+	// Lower case keys of named map types take precedence over methods, and struct fields must be upper case.
+	runTalesTest(t, talesTest{
+		vals,
+		`<html><body><p tal:content="tags/joined"></p><p tal:content="settings/count"></p><p tal:content="ptrSettings/count"></p><p tal:content="ptrSettings/summary"></p><p tal:content="user/name | string:none"></p></body></html>`,
+		`<html><body><p>go, tal</p><p>key</p><p>1</p><p>1 settings</p><p>none</p></body></html>`,
+	})
+}
+
+type optionalSettings map[string]interface{}
+
+func (o optionalSettings) TalesLookup(property string) (interface{}, bool) {
+	value, ok := o[property]
+	return value, ok
+}
+
+// configTree resolves dotted keys such as "db.host" from paths like config/db/host.
+type configTree struct {
+	values map[string]interface{}
+	paths  [][]string
+}
+
+func (c *configTree) TalesPath(path []string) (interface{}, int, bool) {
+	c.paths = append(c.paths, path)
+	for consumed := len(path); consumed > 0; consumed-- {
+		if value, ok := c.values[strings.Join(path[:consumed], ".")]; ok {
+			return value, consumed, true
+		}
+	}
+	return nil, 0, false
+}
+
+func TestTalesLookup(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["settings"] = optionalSettings{"theme": nil, "lang": "en", "tags": []string{"a", "b"}}
+
+	runTalesTest(t, talesTest{
+		vals,
+		`<html><body><p tal:condition="exists:settings/theme">theme</p><p tal:condition="exists:settings/missing">missing</p><p tal:content="settings/theme">Default</p><p tal:content="settings/missing | string:missing"></p><p tal:content="settings/lang"></p><p tal:content="settings/tags/length"></p><p tal:content="settings/length"></p></body></html>`,
+		`<html><body><p>theme</p><p></p><p>missing</p><p>en</p><p>2</p><p>3</p></body></html>`,
+	})
+}
+
+func TestTalesPath(t *testing.T) {
+	config := &configTree{values: map[string]interface{}{
+		"db.host": "localhost",
+		"db":      "primary",
+		"site":    map[string]string{"name": "Example"},
+	}}
+	vals := make(map[string]interface{})
+	vals["config"] = config
+	vals["key"] = "host"
+
+	runTalesTest(t, talesTest{
+		vals,
+		`<html><body><p tal:content="config/db/host"></p><p tal:content="config/db"></p><p tal:content="config/db/?key"></p><p tal:content="config/site/name"></p><p tal:content="config/site/missing | string:missing"></p><p tal:content="config/db/host/upper"></p><p tal:content="config/none/host | string:none"></p></body></html>`,
+		`<html><body><p>localhost</p><p>primary</p><p>localhost</p><p>Example</p><p>missing</p><p>LOCALHOST</p><p>none</p></body></html>`,
+	})
+	if len(config.paths) == 0 || strings.Join(config.paths[0], "/") != "db/host" {
+		t.Errorf("Expected TalesPath to be given the remaining path, got %v", config.paths)
+	}
+}
+
+type ctxKey string
+
+type lazyUser struct {
+	name string
+}
+
+func (u *lazyUser) Name(ctx context.Context) string {
+	if ctx.Err() != nil {
+		return "cancelled"
+	}
+	return u.name + " for " + fmt.Sprint(ctx.Value(ctxKey("request")))
+}
+
+func (u *lazyUser) Greeting(ctx context.Context, greeting string) string {
+	return greeting + " " + u.name + " from " + fmt.Sprint(ctx.Value(ctxKey("request")))
+}
+
+type requestValues struct{}
+
+func (requestValues) TalesValueContext(ctx context.Context, property string) interface{} {
+	return ctx.Value(ctxKey(property))
+}
+
+func TestRenderContext(t *testing.T) {
+	vals := make(map[string]interface{})
+	vals["user"] = &lazyUser{"Alice"}
+	vals["request"] = requestValues{}
+	vals["lookup"] = func(ctx context.Context, id int) string {
+		return fmt.Sprintf("record %d for %v", id, ctx.Value(ctxKey("request")))
+	}
+
+	tmpl, err := CompileTemplate(strings.NewReader(`<p tal:content="user/Name"></p><p tal:content="user/Greeting/Hi"></p><p tal:content="request/request"></p><p tal:content="lookup/42"></p>`))
+	if err != nil {
+		t.Fatalf("Error compiling template: %v", err)
+	}
+	ctx := context.WithValue(context.Background(), ctxKey("request"), "req-1")
+	out := &bytes.Buffer{}
+	if err := tmpl.RenderContext(ctx, vals, out); err != nil {
+		t.Fatalf("Error rendering template: %v", err)
+	}
+	expected := `<p>Alice for req-1</p><p>Hi Alice from req-1</p><p>req-1</p><p>record 42 for req-1</p>`
+	if out.String() != expected {
+		t.Errorf("Expected %v, got %v", expected, out.String())
+	}
+
+	// Render uses a background context.
+	out.Reset()
+	if err := tmpl.Render(vals, out); err != nil {
+		t.Fatalf("Error rendering template: %v", err)
+	}
+	expected = `<p>Alice for &lt;nil&gt;</p><p>Hi Alice from &lt;nil&gt;</p><p></p><p>record 42 for &lt;nil&gt;</p>`
+	if out.String() != expected {
+		t.Errorf("Expected %v, got %v", expected, out.String())
+	}
+}
+
+func TestRenderContextCancelRepeat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	vals := make(map[string]interface{})
+	vals["items"] = []int{1, 2, 3, 4}
+	vals["show"] = func(ctx context.Context, item int) int {
+		if item == 2 {
+			cancel()
+		}
+		return item
+	}
+
+	tmpl, err := CompileTemplate(strings.NewReader(`<ul><li tal:repeat="item items" tal:content="show/?item"></li></ul>`))
+	if err != nil {
+		t.Fatalf("Error compiling template: %v", err)
+	}
+	out := &bytes.Buffer{}
+	err = tmpl.RenderContext(ctx, vals, out)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if out.String() != `<ul><li>1</li><li>2</li>` {
+		t.Errorf("Expected rendering to stop after the second item, got %v", out.String())
+	}
+}
+
+func TestRenderContextDeadlineMacro(t *testing.T) {
+	macroTmpl, err := CompileTemplate(strings.NewReader(`<div metal:define-macro="box">Box <b metal:define-slot="content"></b></div>`))
+	if err != nil {
+		t.Fatalf("Error compiling template: %v", err)
+	}
+	tmpl, err := CompileTemplate(strings.NewReader(`<p>Before</p><div metal:use-macro="page/box"></div>`))
+	if err != nil {
+		t.Fatalf("Error compiling template: %v", err)
+	}
+	vals := map[string]interface{}{"page": macroTmpl}
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	out := &bytes.Buffer{}
+	err = tmpl.RenderContext(ctx, vals, out)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if out.String() != "" {
+		t.Errorf("Expected no output, got %v", out.String())
+	}
+
+	// A deadline that passes while rendering stops at the macro.
+	deadlineCtx, deadlineCancel := context.WithCancel(context.Background())
+	vals["stop"] = func() string {
+		deadlineCancel()
+		return "Stopping"
+	}
+	tmpl, err = CompileTemplate(strings.NewReader(`<p tal:content="stop">Before</p><div metal:use-macro="page/box"></div>`))
+	if err != nil {
+		t.Fatalf("Error compiling template: %v", err)
+	}
+	out.Reset()
+	err = tmpl.RenderContext(deadlineCtx, vals, out)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if out.String() != `<p>Stopping</p>` {
+		t.Errorf("Expected output to stop before the macro, got %v", out.String())
+	}
+}
+
 type talesTest struct {
 	Context  interface{}
 	Template string
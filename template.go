@@ -5,9 +5,12 @@
 package tal
 
 import (
+	"context"
 	"fmt"
 	"golang.org/x/net/html"
 	"io"
+	"reflect"
+	"sort"
 	"strings"
 )
 
@@ -62,6 +65,92 @@ func (a *attributesList) Set(name string, value string) bool {
 	return false
 }
 
+/*
+SetValue applies the result of a tal:attributes expression to the named attribute.
+
+A nil value removes the attribute and Default leaves it unchanged.  HTML5
+boolean attributes are set to their own name if the value is true and removed
+otherwise.  All other values are set to their string value using the
+Formatter.  Values not allowed by the policy are treated as false and output
+as an empty string.
+*/
+func (a *attributesList) SetValue(name string, value interface{}, t *tales) {
+	if value == nil {
+		// Need to remove this attribute from the list.
+		a.Remove(name)
+		return
+	}
+	if value == Default {
+		return
+	}
+	// Over-ride the value
+	// If it's a boolean attribute, use the expression to determine what to do.
+	_, booleanAtt := htmlBooleanAttributes[name]
+	if booleanAtt {
+		if t.isTrue(value) {
+			// True boolean attributes get the value of their name
+			a.Set(name, name)
+		} else {
+			// We remove the attribute
+			a.Remove(name)
+		}
+		return
+	}
+	// Normal attribute - just set to the string value.
+	a.Set(name, t.format(value))
+}
+
+/*
+Spread applies a collection of attributes using the same rules as SetValue.
+
+The value may be a slice of html.Attribute or a map with string keys.  Map
+entries are applied in key order so that the output is stable.  Any other
+value, including nil and Default, leaves the attributes unchanged.  Names
+that are not valid HTML attribute names are ignored.  Values not allowed by
+the policy leave the attributes unchanged.
+*/
+func (a *attributesList) Spread(value interface{}, t *tales) {
+	if !t.allowValue(value) {
+		return
+	}
+	switch atts := value.(type) {
+	case []html.Attribute:
+		for _, att := range atts {
+			a.spreadValue(att.Key, att.Val, t)
+		}
+		return
+	case map[string]string:
+		keys := make([]string, 0, len(atts))
+		for k := range atts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			a.spreadValue(k, atts[k], t)
+		}
+		return
+	}
+	mapValue := reflect.ValueOf(value)
+	if mapValue.Kind() != reflect.Map || mapValue.Type().Key().Kind() != reflect.String {
+		return
+	}
+	keys := make([]string, 0, mapValue.Len())
+	for _, k := range mapValue.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		a.spreadValue(k, mapValue.MapIndex(reflect.ValueOf(k).Convert(mapValue.Type().Key())).Interface(), t)
+	}
+}
+
+// spreadValue calls SetValue for attributes with a valid name.
+func (a *attributesList) spreadValue(name string, value interface{}, t *tales) {
+	if validAttributeName(name) {
+		a.SetValue(name, value, t)
+	}
+}
+
 // Get returns the named attribute, or notFound if not present.
 func (a *attributesList) Get(name string) interface{} {
 	curList := *a
@@ -104,8 +193,21 @@ func (d *defineSlot) render(rc *renderContext) error {
 	slotFilling, ok := rc.slots.GetValue(d.name)
 	if ok {
 		slotFillingTemplate := slotFilling.(*Template)
+		if err := rc.checkCancelled(); err != nil {
+			return err
+		}
+		if err := rc.talesContext.limits.enter(); err != nil {
+			return err
+		}
+		// A slot filling can define the same slot, so is tracked like a macro.
+		if err := rc.talesContext.limits.enterMacro(slotFillingTemplate); err != nil {
+			rc.talesContext.limits.leave()
+			return err
+		}
 		// Found a slot filling - substitute it
 		err := slotFillingTemplate.renderAsSubtemplate(rc.talesContext, rc.out, rc.slots, rc.config...)
+		rc.talesContext.limits.leaveMacro()
+		rc.talesContext.limits.leave()
 		// Rendered the macro - skip the default content.
 		rc.instructionPointer += d.endTagOffset
 		return err
@@ -156,6 +258,16 @@ func (u *useMacro) render(rc *renderContext) error {
 
 	mv, ok := contextValue.(*Template)
 	if ok {
+		if err := rc.checkCancelled(); err != nil {
+			return err
+		}
+		if err := rc.talesContext.limits.enter(); err != nil {
+			return err
+		}
+		if err := rc.talesContext.limits.enterMacro(mv); err != nil {
+			rc.talesContext.limits.leave()
+			return err
+		}
 		// Save current state and add slots
 		rc.slots.SaveAll()
 		for k, v := range u.filledSlots {
@@ -164,6 +276,8 @@ func (u *useMacro) render(rc *renderContext) error {
 
 		// Render the macro
 		err := mv.renderAsSubtemplate(rc.talesContext, rc.out, rc.slots, rc.config...)
+		rc.talesContext.limits.leaveMacro()
+		rc.talesContext.limits.leave()
 
 		// Now restore the state of the slots before this.
 		rc.slots.RestoreAll()
@@ -189,6 +303,8 @@ type renderEndTag struct {
 	// checkOmitTagFlag is true if the tag had a tal:omit-tag command on it.
 	// If the flag is true then the context is checked to see whether the end tag should be omitted.
 	checkOmitTagFlag bool
+	// source holds the end tag as written, if the template preserves source.
+	source []byte
 }
 
 /*
@@ -207,10 +323,16 @@ func (d *renderEndTag) render(rc *renderContext) error {
 	if render {
 		rc.debug("End Tag will be rendered\n")
 		rc.buffer.reset()
-		rc.buffer.appendString("</")
-		rc.buffer.append(d.tagName)
-		rc.buffer.appendString(">")
-		rc.out.Write(rc.buffer)
+		if d.source != nil {
+			rc.buffer.append(d.source)
+		} else {
+			rc.buffer.appendString("</")
+			rc.buffer.append(d.tagName)
+			rc.buffer.appendString(">")
+		}
+		if err := rc.write(rc.buffer); err != nil {
+			return err
+		}
 	} else {
 		rc.debug("Rendering of end tag suppressed.\n")
 	}
@@ -388,6 +510,11 @@ func (d *renderEndRepeat) render(rc *renderContext) error {
 	// Update the value of the local variable.
 	rc.talesContext.localVariables.SetValue(d.repeatName, repeatVar.indexedValue())
 
+	// Stop before the next iteration if the render has been cancelled.
+	if err := rc.checkCancelled(); err != nil {
+		return err
+	}
+
 	// Finally loop back around the start tag.
 	rc.instructionPointer += d.repeatStartOffset
 	return nil
@@ -409,11 +536,7 @@ type renderData struct {
 render for plain text output.
 */
 func (d *renderData) render(rc *renderContext) error {
-	_, err := rc.out.Write(d.data)
-	if err != nil {
-		return err
-	}
-	return nil
+	return rc.write(d.data)
 }
 
 // String returns a text description fo the instruction
@@ -425,6 +548,50 @@ func (d *renderData) String() string {
 	return fmt.Sprintf("[Output] %v", strings.Replace(dataStr, string('\n'), `\n`, -1))
 }
 
+/*
+attributeInterpolation holds an attribute whose value contains one or more
+${expression} parts.
+*/
+type attributeInterpolation struct {
+	// name of the attribute
+	name string
+	// parts of the value to be interpolated
+	parts []interpolationPart
+}
+
+/*
+renderInterpolation is the templateInstruction for ${expression} in text.
+*/
+type renderInterpolation struct {
+	// expression holds the TALES expression to be evaluated.
+	expression string
+	// format holds the optional format specifier for the value.
+	format string
+}
+
+/*
+render for an interpolated expression in text.
+
+The expression is evaluated and the escaped value is output.  Nothing is
+output for nil and Default.  The result of sanitize: expressions is output
+without escaping.
+*/
+func (d *renderInterpolation) render(rc *renderContext) error {
+	value := rc.talesContext.evaluate(d.expression, nil)
+	if value == nil || value == Default {
+		return nil
+	}
+	if markup, ok := value.(structureValue); ok && d.format == "" {
+		return rc.write([]byte(markup))
+	}
+	return rc.write([]byte(html.EscapeString(rc.talesContext.formatValue(value, d.format))))
+}
+
+// String returns a text description fo the instruction
+func (d *renderInterpolation) String() string {
+	return fmt.Sprintf("[Interpolation] '%v'", d.expression)
+}
+
 /*
 renderCondition is the templateInstruction for tal:condition.
 */
@@ -450,7 +617,7 @@ func (d *renderCondition) render(rc *renderContext) error {
 	if d.condition != "" {
 		contentValue = rc.talesContext.evaluate(d.condition, d.originalAttributes)
 	}
-	if trueOrFalse(contentValue) {
+	if rc.talesContext.isTrue(contentValue) {
 		// Carry on - nothing to do.
 		return nil
 	}
@@ -476,12 +643,17 @@ type renderStartTag struct {
 	// contentExpression holds the TALES expression to be evaluated if the
 	// content of the tag is to be changed
 	contentExpression string
+	// contentFunc is used in place of contentExpression by registered commands
+	contentFunc RenderFunc
 	// originalAttributes holds a copy of the original attributes associated
 	// with the start tag
 	originalAttributes attributesList
 	// attributeExpression holds the list of TALES expressions to be evaluated
 	// (i.e. tal:attributes)
 	attributeExpression []html.Attribute
+	// attributeInterpolations holds the original attributes that contain
+	// ${expression} values
+	attributeInterpolations []attributeInterpolation
 	// If replaceCommand is true then the element is replaced entirely
 	// (i.e. tal:replace)
 	replaceCommand bool
@@ -493,6 +665,12 @@ type renderStartTag struct {
 	// voidElement is true if this HTML tag should not have an end tag
 	// (e.g. <img>)
 	voidElement bool
+	// rawText is true if this HTML tag is a raw text element
+	// (e.g. <script>), whose content can not use character references
+	rawText bool
+	// attributeSource holds the attributes as written, if the template
+	// preserves source
+	attributeSource map[string]string
 }
 
 // String returns a text description fo the instruction
@@ -503,7 +681,7 @@ func (d *renderStartTag) String() string {
 	desc.appendString("[Start Tag] %v")
 	params = append(params, string(d.tagName))
 
-	if d.contentExpression != "" {
+	if d.contentExpression != "" || d.contentFunc != nil {
 		if d.contentStructure {
 			desc.appendString(" structure")
 		}
@@ -512,7 +690,11 @@ func (d *renderStartTag) String() string {
 		} else {
 			desc.appendString(" content of '%v'")
 		}
-		params = append(params, d.contentExpression)
+		if d.contentFunc != nil {
+			params = append(params, "[Render Func]")
+		} else {
+			params = append(params, d.contentExpression)
+		}
 	}
 
 	if len(d.attributeExpression) > 0 {
@@ -550,11 +732,14 @@ If there is a tal:replace command that did not evaluate to Default, execution
 jumps to the end tag.
 */
 func (d *renderStartTag) render(rc *renderContext) error {
+	if d.contentStructure && rc.talesContext.policy != nil && !rc.talesContext.policy.AllowStructure() {
+		return &PolicyError{Expression: d.contentExpression}
+	}
 	// If tal:omit-tag has been used, always ensure that we have called addOmitTagFlag()
 	omitTagFlag := false
 	if d.omitTagExpression != "" {
 		omitTagValue := rc.talesContext.evaluate(d.omitTagExpression, d.originalAttributes)
-		omitTagFlag = trueOrFalse(omitTagValue)
+		omitTagFlag = rc.talesContext.isTrue(omitTagValue)
 		// Add this onto the context
 		rc.debug("Omit Tag Flag %v - Omit Tag Value %v - Void %v\n", omitTagFlag, omitTagValue, d.voidElement)
 		if !d.voidElement {
@@ -563,7 +748,14 @@ func (d *renderStartTag) render(rc *renderContext) error {
 	}
 
 	var contentValue interface{}
-	if d.contentExpression != "" {
+	hasContent := d.contentExpression != "" || d.contentFunc != nil
+	if d.contentFunc != nil {
+		var err error
+		contentValue, err = d.contentFunc(&RenderState{rc: rc, originalAttributes: d.originalAttributes})
+		if err != nil {
+			return err
+		}
+	} else if d.contentExpression != "" {
 		contentValue = rc.talesContext.evaluate(d.contentExpression, d.originalAttributes)
 	}
 
@@ -573,34 +765,25 @@ func (d *renderStartTag) render(rc *renderContext) error {
 	if contentValue == Default || (!d.replaceCommand && !omitTagFlag) {
 		// We are going to write out a start tag, so it's worth evaluating any tal:attribute values at this point.
 		var attributes attributesList
-		if len(d.attributeExpression) == 0 {
+		if len(d.attributeExpression) == 0 && len(d.attributeInterpolations) == 0 {
 			// No tal:attributes - just use the original values.
 			attributes = d.originalAttributes
 		} else {
 			// Start by taking a copy of the original attributes
 			attributes = append(attributes, d.originalAttributes...)
+			// Interpolate any ${expression} values before tal:attributes has a chance to override them.
+			for _, interpolation := range d.attributeInterpolations {
+				attributes.Set(interpolation.name, rc.talesContext.interpolate(interpolation.parts, d.originalAttributes))
+			}
 			// Now evaluate each tal:attribute and see what needs to be done.
 			for _, talAtt := range d.attributeExpression {
 				attValue := rc.talesContext.evaluate(talAtt.Val, d.originalAttributes)
-				if attValue == nil {
-					// Need to remove this attribute from the list.
-					attributes.Remove(talAtt.Key)
-				} else if attValue != Default {
-					// Over-ride the value
-					// If it's a boolean attribute, use the expression to determine what to do.
-					_, booleanAtt := htmlBooleanAttributes[talAtt.Key]
-					if booleanAtt {
-						if trueOrFalse(attValue) {
-							// True boolean attributes get the value of their name
-							attributes.Set(talAtt.Key, talAtt.Key)
-						} else {
-							// We remove the attribute
-							attributes.Remove(talAtt.Key)
-						}
-					} else {
-						// Normal attribute - just set to the string value.
-						attributes.Set(talAtt.Key, fmt.Sprint(attValue))
-					}
+				if talAtt.Key == attributeSpreadKey {
+					// The expression provides a whole set of attributes.
+					rc.debug("Spreading attributes from %v\n", attValue)
+					attributes.Spread(attValue, rc.talesContext)
+				} else {
+					attributes.SetValue(talAtt.Key, attValue, rc.talesContext)
 				}
 			}
 		}
@@ -608,6 +791,10 @@ func (d *renderStartTag) render(rc *renderContext) error {
 		rc.buffer.appendString("<")
 		rc.buffer.append(d.tagName)
 		for _, att := range attributes {
+			if source, ok := d.sourceAttribute(att); ok {
+				rc.buffer.appendString(source)
+				continue
+			}
 			rc.buffer.appendString(" ")
 			rc.buffer.appendString(att.Key)
 			rc.buffer.appendString("=\"")
@@ -615,18 +802,28 @@ func (d *renderStartTag) render(rc *renderContext) error {
 			rc.buffer.appendString("\"")
 		}
 		rc.buffer.appendString(">")
-		rc.out.Write(rc.buffer)
+		if err := rc.write(rc.buffer); err != nil {
+			return err
+		}
 	}
 
-	if contentValue == Default || d.contentExpression == "" {
+	if contentValue == Default || !hasContent {
 		return nil
 	}
 
 	if contentValue != nil {
-		if d.contentStructure {
-			rc.out.Write([]byte(fmt.Sprint(contentValue)))
+		var err error
+		if markup, ok := contentValue.(structureValue); ok {
+			err = rc.write([]byte(markup))
+		} else if d.contentStructure {
+			err = rc.write([]byte(rc.talesContext.format(contentValue)))
+		} else if d.rawText {
+			err = rc.write([]byte(escapeRawText(rc.talesContext.format(contentValue))))
 		} else {
-			rc.out.Write([]byte(html.EscapeString(fmt.Sprint(contentValue))))
+			err = rc.write([]byte(html.EscapeString(rc.talesContext.format(contentValue))))
+		}
+		if err != nil {
+			return err
 		}
 	}
 
@@ -663,6 +860,28 @@ type renderContext struct {
 	slots *variableContainer
 }
 
+/*
+write writes data to the output, wrapping any error in a WriteError.  The
+output limit is checked before anything is written.
+*/
+func (rc *renderContext) write(data []byte) error {
+	if err := rc.talesContext.limits.countOutput(len(data)); err != nil {
+		return err
+	}
+	if _, err := rc.out.Write(data); err != nil {
+		return &WriteError{Err: err}
+	}
+	return nil
+}
+
+/*
+checkCancelled returns the error of the context given to RenderContext if it
+has been cancelled or its deadline has passed.
+*/
+func (rc *renderContext) checkCancelled() error {
+	return rc.talesContext.ctx.Err()
+}
+
 /*
 getOmitTagFlag returns the last omit tag flag state on the render context stack.
 The flag is true if the end tag should be omitted from output, false otherwise.
@@ -696,6 +915,8 @@ goroutines simultaneously.
 type Template struct {
 	instructions []templateInstruction
 	macros       map[string]*Template
+	// name is the name of a macro or slot filling, used when reporting recursion
+	name string
 }
 
 // newTemplate creates a new empty template.
@@ -768,13 +989,38 @@ called.  Functions and methods are called with no arguments and the first value
 returned is used as the resulting value.
 
 A RenderConfig option can be provided to set debug logging.
+
+Render is equivalent to RenderContext with context.Background().
+*/
+func (t *Template) Render(data interface{}, out io.Writer, config ...RenderConfig) error {
+	return t.RenderContext(context.Background(), data, out, config...)
+}
+
+/*
+RenderContext renders the template in the same way as Render, making ctx
+available to the data being rendered.
+
+Functions and methods whose first parameter is a context.Context are called
+with ctx, followed by any path argument.  Objects implementing
+TalesValueContext are given ctx when resolving properties.
+
+If ctx is cancelled or its deadline passes, rendering stops at the next
+iteration of a tal:repeat or use of a macro or slot and ctx.Err() is
+returned.  Output already written to out is not removed.
+
+If writing to out fails, rendering stops and a *WriteError wrapping the
+error from out is returned.  Output written before the failure is not
+removed, so callers that need all or nothing output should render into a
+buffer first.
 */
-func (t *Template) Render(context interface{}, out io.Writer, config ...RenderConfig) error {
+func (t *Template) RenderContext(ctx context.Context, data interface{}, out io.Writer, config ...RenderConfig) error {
+	talesContext := newTalesContext(data)
+	talesContext.ctx = ctx
 	rc := &renderContext{
 		template:     t,
 		out:          out,
 		buffer:       make(buffer, 0, 1024),
-		talesContext: newTalesContext(context),
+		talesContext: talesContext,
 		debug:        defaultLogger,
 		config:       config,
 		slots:        newContainer(),
@@ -782,6 +1028,9 @@ func (t *Template) Render(context interface{}, out io.Writer, config ...RenderCo
 	for _, c := range config {
 		c(t, rc)
 	}
+	if err := rc.checkCancelled(); err != nil {
+		return err
+	}
 
 	// Put our macros under /macros
 	rc.talesContext.globalVariables.SetValue("macros", t)
@@ -789,10 +1038,17 @@ func (t *Template) Render(context interface{}, out io.Writer, config ...RenderCo
 	for rc.instructionPointer < len(t.instructions) {
 		instruction := t.instructions[rc.instructionPointer]
 		rc.debug("Executing instruction %v\n", instruction)
+		if err := rc.talesContext.limits.countInstruction(); err != nil {
+			return err
+		}
 		err := instruction.render(rc)
 		if err != nil {
 			return err
 		}
+		// Errors found while evaluating expressions, such as policy errors, stop the render.
+		if rc.talesContext.err != nil {
+			return rc.talesContext.err
+		}
 		rc.instructionPointer++
 	}
 	return nil
@@ -836,10 +1092,17 @@ func (t *Template) renderAsSubtemplate(context *tales, out io.Writer, slots *var
 	for rc.instructionPointer < len(t.instructions) {
 		instruction := t.instructions[rc.instructionPointer]
 		rc.debug("Executing renderAsSubtemplate instruction %v\n", instruction)
+		if err := rc.talesContext.limits.countInstruction(); err != nil {
+			return err
+		}
 		err := instruction.render(rc)
 		if err != nil {
 			return err
 		}
+		// Errors found while evaluating expressions, such as policy errors, stop the render.
+		if rc.talesContext.err != nil {
+			return rc.talesContext.err
+		}
 		rc.instructionPointer++
 	}
 	return nil